@@ -0,0 +1,31 @@
+package nft_proxy
+
+import "time"
+
+type BlockKind string
+
+const (
+	BlockKindMint            BlockKind = "mint"
+	BlockKindCollection      BlockKind = "collection"
+	BlockKindUpdateAuthority BlockKind = "update_authority"
+)
+
+var BlockKinds = []BlockKind{BlockKindMint, BlockKindCollection, BlockKindUpdateAuthority}
+
+func (k BlockKind) Valid() bool {
+	for _, kind := range BlockKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedMedia is a moderation entry, media matching the key for its kind is served with a replacement image
+type BlockedMedia struct {
+	ID        uint      `json:"-" gorm:"primaryKey"`
+	Kind      BlockKind `json:"kind" gorm:"uniqueIndex:idx_blocked_kind_key"`
+	Key       string    `json:"key" gorm:"uniqueIndex:idx_blocked_kind_key"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
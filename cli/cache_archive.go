@@ -0,0 +1,558 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+	services "github.com/alphabatem/nft-proxy/service"
+	"github.com/babilu-online/common/context"
+	"github.com/joho/godotenv"
+)
+
+// Archive layout, rows are always the first entry so import can verify each file as it is streamed
+const (
+	archiveRows     = "media.jsonl"
+	archiveFilesDir = "files/"
+
+	exportBatchSize = 500
+	importBatchSize = 500
+)
+
+// ArchiveRow is a SolanaMedia row along with the cached files belonging to the mint
+type ArchiveRow struct {
+	nft_proxy.SolanaMedia
+	LocalPath string        `json:"localPath"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Files     []ArchiveFile `json:"files,omitempty"`
+}
+
+// ArchiveFile is a cached file, Name is relative to the cache directory
+type ArchiveFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file loaded: %s", err)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "export":
+		err = runExport(os.Args[2:])
+	case "import":
+		err = runImport(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: go run cli/cache_archive.go export|import [flags]")
+	os.Exit(2)
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "./cache_export.tar.gz", "Archive to write, gzipped when ending in .gz, - for stdout")
+	cacheDir := fs.String("cache", "", "Image cache directory (default cache.dir from the config)")
+	authority := fs.String("authority", "", "Only export mints with this update authority (comma separated)")
+	since := fs.String("since", "", "Only export rows created on or after this date (YYYY-MM-DD or RFC3339)")
+	until := fs.String("until", "", "Only export rows created before this date (YYYY-MM-DD or RFC3339)")
+	noFiles := fs.Bool("no-files", false, "Export rows only")
+	_ = fs.Parse(args)
+
+	ctx, err := context.NewCtx(&services.ConfigService{}, &services.StorageService{})
+	if err != nil {
+		return fmt.Errorf("failed to initialize context: %w", err)
+	}
+	if err := ctx.Run(); err != nil {
+		return fmt.Errorf("failed to run context: %w", err)
+	}
+	db := ctx.Service(services.STORAGE_SVC).(*services.StorageService)
+	if *cacheDir == "" {
+		*cacheDir = ctx.Service(services.CONFIG_SVC).(*services.ConfigService).Config.Cache.Dir
+	}
+
+	var filter services.MediaFilter
+	if *authority != "" {
+		filter.UpdateAuthorities = strings.Split(*authority, ",")
+	}
+	if *since != "" {
+		t, err := parseDate(*since)
+		if err != nil {
+			return fmt.Errorf("invalid -since: %w", err)
+		}
+		filter.Since = t
+	}
+	if *until != "" {
+		t, err := parseDate(*until)
+		if err != nil {
+			return fmt.Errorf("invalid -until: %w", err)
+		}
+		filter.Until = t
+	}
+
+	//Rows are staged so the jsonl entry size is known before any files are written
+	rows, err := os.CreateTemp("", "media-*.jsonl")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rows.Name())
+	defer rows.Close()
+
+	rowCount, fileCount := 0, 0
+	enc := json.NewEncoder(rows)
+	err = db.EachMedia(filter, exportBatchSize, func(batch []*nft_proxy.SolanaMedia) error {
+		for _, m := range batch {
+			r := &ArchiveRow{SolanaMedia: *m, LocalPath: m.LocalPath, CreatedAt: m.CreatedAt}
+			if !*noFiles {
+				f, err := cachedFiles(*cacheDir, m.Mint)
+				if err != nil {
+					return err
+				}
+				r.Files = f
+				fileCount += len(f)
+			}
+
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+			rowCount++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	w, closeOut, err := createArchive(*out)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+
+	if err := writeRows(tw, rows); err != nil {
+		return err
+	}
+
+	//Files are listed by rereading the staged rows, so memory doesnt grow with the cache
+	if _, err := rows.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	skipped, corrupt := 0, 0
+	scanner := bufio.NewScanner(rows)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var row ArchiveRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return fmt.Errorf("failed to reread rows: %w", err)
+		}
+
+		for _, f := range row.Files {
+			err := writeFile(tw, *cacheDir, f)
+			if errors.Is(err, errChanged) {
+				log.Printf("%s changed during export, skipping", f.Name)
+				skipped++
+				continue
+			}
+			if errors.Is(err, errChecksum) {
+				log.Printf("%s changed while being written, import will reject it", f.Name)
+				corrupt++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to reread rows: %w", err)
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := closeOut(); err != nil {
+		return err
+	}
+
+	log.Printf("Exported %v rows & %v files (%v skipped) to %s", rowCount, fileCount-skipped, skipped, *out)
+	if corrupt > 0 {
+		return fmt.Errorf("%v files changed while being written, rerun the export", corrupt)
+	}
+	return nil
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("in", "./cache_export.tar.gz", "Archive to read, gzipped when ending in .gz, - for stdin")
+	cacheDir := fs.String("cache", "", "Image cache directory (default cache.dir from the config)")
+	noFiles := fs.Bool("no-files", false, "Import rows only")
+	_ = fs.Parse(args)
+
+	ctx, err := context.NewCtx(
+		&services.ConfigService{},
+		&services.StorageService{},
+		&services.SolanaService{},
+		&services.SolanaImageService{},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to initialize context: %w", err)
+	}
+	if err := ctx.Run(); err != nil {
+		return fmt.Errorf("failed to run context: %w", err)
+	}
+	db := ctx.Service(services.STORAGE_SVC).(*services.StorageService)
+	if *cacheDir == "" {
+		*cacheDir = ctx.Service(services.CONFIG_SVC).(*services.ConfigService).Config.Cache.Dir
+	}
+	solImg := ctx.Service(services.SOLANA_IMG_SVC).(*services.SolanaImageService)
+
+	if err := os.MkdirAll(*cacheDir, 0755); err != nil {
+		return err
+	}
+
+	r, closeIn, err := openArchive(*in)
+	if err != nil {
+		return err
+	}
+	defer closeIn()
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	if hdr.Name != archiveRows {
+		return fmt.Errorf("archive must start with %s, found %s", archiveRows, hdr.Name)
+	}
+
+	expected, rowCount, err := importRows(db, solImg, tr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %v rows", rowCount)
+
+	if *noFiles {
+		return nil
+	}
+
+	restored, mismatched := 0, 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !strings.HasPrefix(hdr.Name, archiveFilesDir) {
+			continue
+		}
+
+		name := strings.TrimPrefix(hdr.Name, archiveFilesDir)
+		f, ok := expected[name]
+		if !ok || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+			log.Printf("Unexpected archive entry %s, skipping", hdr.Name)
+			continue
+		}
+		delete(expected, name)
+
+		err = restoreFile(tr, *cacheDir, f)
+		if errors.Is(err, errChecksum) {
+			log.Printf("%s checksum mismatch, skipping", name)
+			mismatched++
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		restored++
+	}
+
+	log.Printf("Restored %v files, %v checksum mismatches, %v missing from archive", restored, mismatched, len(expected))
+	if mismatched > 0 {
+		return fmt.Errorf("%v files failed checksum verification", mismatched)
+	}
+	return nil
+}
+
+// importRows upserts every row & returns the files the archive should contain by name
+func importRows(db *services.StorageService, solImg *services.SolanaImageService, r io.Reader) (map[string]ArchiveFile, int, error) {
+	expected := map[string]ArchiveFile{}
+	batch := make([]*nft_proxy.SolanaMedia, 0, importBatchSize)
+	count := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.SaveMedia(nil, batch...); err != nil {
+			return fmt.Errorf("failed to upsert rows: %w", err)
+		}
+
+		for _, m := range batch {
+			if m.PHash == "" {
+				continue
+			}
+			hash, err := strconv.ParseUint(m.PHash, 16, 64)
+			if err != nil {
+				continue
+			}
+			if err := solImg.IndexHash(m.Mint, hash); err != nil {
+				log.Printf("%s index hash err: %s", m.Mint, err)
+			}
+		}
+
+		count += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var row ArchiveRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			return nil, count, fmt.Errorf("invalid row %v: %w", count+len(batch)+1, err)
+		}
+
+		m := row.SolanaMedia
+		m.ID = 0 //IDs are local to each database
+		m.LocalPath = row.LocalPath
+		m.CreatedAt = row.CreatedAt
+		batch = append(batch, &m)
+
+		for _, f := range row.Files {
+			expected[f.Name] = f
+		}
+
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				return nil, count, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, count, fmt.Errorf("failed to read rows: %w", err)
+	}
+
+	return expected, count, flush()
+}
+
+var (
+	errChanged  = errors.New("file changed")
+	errChecksum = errors.New("checksum mismatch")
+)
+
+// cachedFiles returns the resized image, vector & frame files cached for the mint
+func cachedFiles(cacheDir, mint string) ([]ArchiveFile, error) {
+	paths, err := filepath.Glob(filepath.Join(cacheDir, mint+".*"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]ArchiveFile, 0, len(paths))
+	for _, p := range paths {
+		size, sum, err := hashFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			continue
+		}
+
+		files = append(files, ArchiveFile{
+			Name:   filepath.Base(p),
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+	return files, nil
+}
+
+// hashFile streams the file through sha256, returning its size & hex encoded sum
+func hashFile(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeRows(tw *tar.Writer, rows *os.File) error {
+	ifo, err := rows.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := rows.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveRows,
+		Mode:    0644,
+		Size:    ifo.Size(),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, rows)
+	return err
+}
+
+// writeFile streams the cached file into the archive, returning errChanged if its size no longer matches its row
+// & errChecksum if the content written doesnt. Cached files are replaced by rename, so an open file cant change under the copy
+func writeFile(tw *tar.Writer, cacheDir string, f ArchiveFile) error {
+	file, err := os.Open(filepath.Join(cacheDir, f.Name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errChanged
+		}
+		return err
+	}
+	defer file.Close()
+
+	ifo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if ifo.Size() != f.Size {
+		return errChanged
+	}
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:    archiveFilesDir + f.Name,
+		Mode:    0644,
+		Size:    f.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), file); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != f.SHA256 {
+		return errChecksum
+	}
+	return nil
+}
+
+// restoreFile writes to a temporary file & only moves it into the cache once the checksum matches
+func restoreFile(r io.Reader, cacheDir string, f ArchiveFile) error {
+	tmp, err := os.CreateTemp(cacheDir, ".import-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != f.SHA256 {
+		return errChecksum
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(cacheDir, f.Name))
+}
+
+func createArchive(path string) (io.Writer, func() error, error) {
+	var out io.WriteCloser = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		out = f
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return out, out.Close, nil
+	}
+
+	gz := gzip.NewWriter(out)
+	return gz, func() error {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		return out.Close()
+	}, nil
+}
+
+func openArchive(path string) (io.Reader, func() error, error) {
+	var in io.ReadCloser = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		in = f
+	}
+
+	br := bufio.NewReader(in)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return br, in.Close, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		in.Close()
+		return nil, nil, err
+	}
+	return gz, in.Close, nil
+}
+
+func parseDate(v string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
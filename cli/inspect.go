@@ -0,0 +1,160 @@
+package main
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+	services "github.com/alphabatem/nft-proxy/service"
+	token_metadata "github.com/alphabatem/nft-proxy/token-metadata"
+	"github.com/babilu-online/common/context"
+	"github.com/gagliardetto/solana-go"
+	"github.com/joho/godotenv"
+)
+
+// Inspection is the report printed for a key
+type Inspection struct {
+	Key             string                       `json:"key"`
+	Owner           string                       `json:"owner"`
+	Protocol        string                       `json:"protocol"`
+	Decimals        uint8                        `json:"decimals"`
+	Extensions      []string                     `json:"extensions,omitempty"`
+	MetadataPointer string                       `json:"metadataPointer,omitempty"`
+	PDAs            map[string]string            `json:"pdas"`
+	MetadataAccount string                       `json:"metadataAccount,omitempty"`
+	Metadata        *token_metadata.Metadata     `json:"metadata"`
+	OffChainURI     string                       `json:"offChainUri,omitempty"`
+	OffChain        json.RawMessage              `json:"offChain,omitempty"`
+	OffChainError   string                       `json:"offChainError,omitempty"`
+	Resolved        *nft_proxy.NFTMetadataSimple `json:"resolved,omitempty"`
+	Stored          *nft_proxy.SolanaMedia       `json:"stored,omitempty"`
+	Error           string                       `json:"error,omitempty"`
+}
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Fprintln(os.Stderr, "usage: go run cli/inspect.go <key>")
+		os.Exit(2)
+	}
+	key, err := solana.PublicKeyFromBase58(os.Args[1])
+	if err != nil {
+		log.Fatalf("Invalid key: %s", err)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file loaded: %s", err)
+	}
+
+	ctx, err := context.NewCtx(
+		&services.ConfigService{},
+		&services.StorageService{},
+		&services.SolanaService{},
+		&services.SolanaImageService{},
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ctx.Run(); err != nil {
+		log.Fatal(err)
+	}
+
+	sol := ctx.Service(services.SOLANA_SVC).(*services.SolanaService)
+	solImg := ctx.Service(services.SOLANA_IMG_SVC).(*services.SolanaImageService)
+
+	runCtx, stop := signal.NotifyContext(gocontext.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	out := inspect(runCtx, sol, solImg, key)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func inspect(ctx gocontext.Context, sol *services.SolanaService, solImg *services.SolanaImageService, key solana.PublicKey) *Inspection {
+	out := &Inspection{Key: key.String(), PDAs: map[string]string{}}
+
+	ins, err := sol.Inspect(ctx, key)
+	if ins == nil {
+		out.Error = err.Error()
+		return out
+	}
+	if err != nil {
+		out.Error = err.Error()
+	}
+
+	if !ins.Owner.IsZero() {
+		out.Owner = ins.Owner.String()
+	}
+	out.Decimals = ins.Decimals
+	out.Extensions = ins.Extensions
+	if ins.MetadataPointer != nil {
+		out.MetadataPointer = ins.MetadataPointer.String()
+	}
+	out.PDAs["tokenMetadata"] = ins.LegacyPDA.String()
+	out.PDAs["token22Metadata"] = ins.Token22PDA.String()
+
+	if ins.Metadata == nil {
+		out.Protocol = "none"
+		return out
+	}
+
+	out.Protocol = ins.Metadata.Protocol.String()
+	out.MetadataAccount = ins.MetadataAccount.String()
+	out.Metadata = ins.Metadata
+	out.OffChainURI = strings.Trim(ins.Metadata.Data.Uri, "\x00")
+
+	if out.OffChainURI != "" && ins.Metadata.Protocol != token_metadata.PROTOCOL_METAPLEX_CORE {
+		raw, err := fetchOffChain(out.OffChainURI)
+		if err != nil {
+			out.OffChainError = err.Error()
+		} else {
+			out.OffChain = raw
+		}
+	}
+
+	resolved, err := solImg.MetadataFromToken(ctx, ins.Metadata, ins.Decimals)
+	if err != nil {
+		out.Error = err.Error()
+		return out
+	}
+	out.Resolved = resolved
+	out.Stored = solImg.MediaFromMetadata(key.String(), resolved, "")
+
+	return out
+}
+
+// fetchOffChain returns the raw off-chain JSON, non JSON bodies are returned as a JSON string
+func fetchOffChain(uri string) (json.RawMessage, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if json.Valid(data) {
+		return data, nil
+	}
+	return json.Marshal(string(data))
+}
@@ -1,11 +1,26 @@
 package main
 
 import (
+	"bufio"
+	gocontext "context"
 	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	nft_proxy "github.com/alphabatem/nft-proxy"
-	token_metadata "github.com/gagliardetto/metaplex-go/clients/token-metadata"
+	services "github.com/alphabatem/nft-proxy/service"
+	token_metadata "github.com/alphabatem/nft-proxy/token-metadata"
+	"github.com/babilu-online/common/context"
+	"github.com/gagliardetto/solana-go"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/joho/godotenv"
 )
 
 type collectionLoader struct {
@@ -13,50 +28,154 @@ type collectionLoader struct {
 	fileWorkerCount  int
 	mediaWorkerCount int
 
-	done chan struct{} // Add channel for graceful shutdown
+	sol    *services.SolanaService
+	solImg *services.SolanaImageService
+	img    *services.ImageService
+
+	checkpoint *checkpoint
+
+	ctx  gocontext.Context // Cancelled on interrupt to stop in-flight fetches
+	done chan struct{}     // Closed on interrupt to stop feeding the pipeline
 
 	metaDataIn chan *token_metadata.Metadata
-	fileDataIn chan *nft_proxy.NFTMetadataSimple
+	fileDataIn chan *collectionFile
 	mediaIn    chan *nft_proxy.Media
+
+	loaded uint64
+	failed uint64
+}
+
+// collectionFile carries resolved off-chain metadata along with the mint it belongs to
+type collectionFile struct {
+	mint     string
+	metadata *nft_proxy.NFTMetadataSimple
 }
 
 func main() {
-	log.Printf("Loading collection images: %s", "TODO")
+	if err := runLoader(); err != nil {
+		log.Fatal(err)
+	}
+}
 
-	l := collectionLoader{
-		metaWorkerCount:  3,
-		fileWorkerCount:  3,
-		mediaWorkerCount: 1,
-		metaDataIn:       make(chan *token_metadata.Metadata),
-		fileDataIn:       make(chan *nft_proxy.NFTMetadataSimple),
-		mediaIn:          make(chan *nft_proxy.Media),
+// runLoader loads the images, returning rather than exiting so the checkpoint is closed on every path
+func runLoader() error {
+	collection := flag.String("collection", "", "Only load items verified in this collection mint, combine with -creator or -authority to find the mints")
+	creator := flag.String("creator", "", "First verified creator address")
+	authority := flag.String("authority", "", "Update authority address")
+	checkpointPath := flag.String("checkpoint", "", "Checkpoint file of completed mints (default ./collection_<key>.checkpoint)")
+	metaWorkers := flag.Int("meta-workers", 3, "Off-chain metadata workers")
+	fileWorkers := flag.Int("file-workers", 3, "Image download workers")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file loaded: %s", err)
+	}
+
+	filter, key, err := collectionFilter(*collection, *creator, *authority)
+	if err != nil {
+		return err
 	}
 
-	l.spawnWorkers()
+	if *checkpointPath == "" {
+		*checkpointPath = fmt.Sprintf("./collection_%s.checkpoint", key)
+	}
+	cp, err := openCheckpoint(*checkpointPath)
+	if err != nil {
+		return fmt.Errorf("failed to open checkpoint: %w", err)
+	}
+	defer cp.Close()
 
-	//TODO Get collection
-	err := l.loadCollection()
+	ctx, err := context.NewCtx(
+		&services.ConfigService{},
+		&services.StorageService{},
+		&services.BlocklistService{},
+		&services.ResizeService{},
+		&services.SolanaService{},
+		&services.SolanaImageService{},
+		&services.CacheService{Passive: true},
+		&services.ImageService{},
+	)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if err := ctx.Run(); err != nil {
+		return err
 	}
 
-	//TODO Fetch all the mints for that collection
-	//TODO Fetch Mints/Hash List
+	log.Printf("Loading collection images: %s (%v already complete)", key, cp.Len())
+
+	runCtx, cancel := gocontext.WithCancel(gocontext.Background())
+	defer cancel()
+
+	l := collectionLoader{
+		metaWorkerCount:  *metaWorkers,
+		fileWorkerCount:  *fileWorkers,
+		mediaWorkerCount: 1,
+		sol:              ctx.Service(services.SOLANA_SVC).(*services.SolanaService),
+		solImg:           ctx.Service(services.SOLANA_IMG_SVC).(*services.SolanaImageService),
+		img:              ctx.Service(services.IMG_SVC).(*services.ImageService),
+		checkpoint:       cp,
+		ctx:              runCtx,
+		done:             make(chan struct{}),
+		metaDataIn:       make(chan *token_metadata.Metadata, 100),
+		fileDataIn:       make(chan *collectionFile, 100),
+		mediaIn:          make(chan *nft_proxy.Media, 100),
+	}
 
-	//TODO Batch into batches of 100
-	//TODO Pass to metaDataIn<-
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		log.Printf("Interrupted, cancelling in-flight mints")
+		close(l.done)
+		cancel()
+	}()
 
-	//TODO Fetch all the metadata accounts for that collection
-	//TODO Fetch all images for the accounts
-	//TODO Fetch Image
-	//TODO Resize Image 500x500
-	//TODO Fetch Media
+	wait := l.spawnWorkers()
+
+	err = l.loadCollection(filter, *collection)
+	close(l.metaDataIn)
+	wait()
+
+	log.Printf("Loaded %v mints, %v failed", atomic.LoadUint64(&l.loaded), atomic.LoadUint64(&l.failed))
+	return err
 }
 
-func (l *collectionLoader) spawnWorkers() {
-	spawnWorker := func(worker func(), count int) {
+// collectionFilter builds the metadata account filter for the creator or update authority.
+// Collections have no fixed offset so cant be filtered by getProgramAccounts, a collection only narrows the mints found
+func collectionFilter(collection, creator, authority string) (rpc.RPCFilter, string, error) {
+	if (creator == "") == (authority == "") {
+		return rpc.RPCFilter{}, "", errors.New("exactly one of -creator or -authority is required, -collection only narrows the mints they find")
+	}
+	if collection != "" {
+		if _, err := solana.PublicKeyFromBase58(collection); err != nil {
+			return rpc.RPCFilter{}, "", err
+		}
+	}
+
+	offset, key := uint64(services.METADATA_FIRST_CREATOR_OFFSET), creator
+	if authority != "" {
+		offset, key = services.METADATA_UPDATE_AUTHORITY_OFFSET, authority
+	}
+	pk, err := solana.PublicKeyFromBase58(key)
+	if err != nil {
+		return rpc.RPCFilter{}, "", err
+	}
+
+	if collection != "" {
+		key = collection
+	}
+	return rpc.RPCFilter{Memcmp: &rpc.RPCFilterMemcmp{Offset: offset, Bytes: pk.Bytes()}}, key, nil
+}
+
+// spawnWorkers starts each pipeline stage & returns a func that blocks until every stage has drained
+func (l *collectionLoader) spawnWorkers() func() {
+	spawnWorker := func(worker func(), count int, next func()) {
+		var wg sync.WaitGroup
 		for i := 0; i < count; i++ {
+			wg.Add(1)
 			go func() {
+				defer wg.Done()
 				defer func() {
 					if r := recover(); r != nil {
 						log.Printf("Recovered from panic in worker: %v", r)
@@ -65,36 +184,89 @@ func (l *collectionLoader) spawnWorkers() {
 				worker()
 			}()
 		}
+		go func() {
+			wg.Wait()
+			next()
+		}()
 	}
-	spawnWorker(l.metaDataWorker, l.metaWorkerCount)
-	spawnWorker(l.fileDataWorker, l.fileWorkerCount)
-	spawnWorker(l.mediaWorker, l.mediaWorkerCount)
+
+	finished := make(chan struct{})
+	spawnWorker(l.metaDataWorker, l.metaWorkerCount, func() { close(l.fileDataIn) })
+	spawnWorker(l.fileDataWorker, l.fileWorkerCount, func() { close(l.mediaIn) })
+	spawnWorker(l.mediaWorker, l.mediaWorkerCount, func() { close(finished) })
+
+	return func() { <-finished }
 }
 
-func (l *collectionLoader) loadCollection() error {
+// loadCollection enumerates the metadata accounts & feeds any not already completed into the pipeline
+func (l *collectionLoader) loadCollection(filter rpc.RPCFilter, collection string) error {
+	metas, err := l.sol.FindMetadataAccounts(l.ctx, filter)
+	if err != nil {
+		return fmt.Errorf("failed to fetch metadata accounts: %w", err)
+	}
+	log.Printf("Found %v metadata accounts", len(metas))
+
+	var filtered int
+	defer func() {
+		if collection != "" {
+			log.Printf("Skipped %v accounts not verified in the collection", filtered)
+		}
+	}()
+
+	for _, m := range metas {
+		if collection != "" && (m.Collection == nil || !m.Collection.Verified || m.Collection.Key.String() != collection) {
+			filtered++
+			continue
+		}
+		if l.checkpoint.Has(m.Mint.String()) {
+			continue
+		}
+
+		select {
+		case l.metaDataIn <- m:
+		case <-l.done:
+			return nil
+		}
+	}
+
 	return nil
 }
 
 // Fetches the off-chain data from the on-chain account & passes to `fileDataWorker`
 func (l *collectionLoader) metaDataWorker() {
-	return
+	for m := range l.metaDataIn {
+		f, err := l.solImg.MetadataFromToken(l.ctx, m, 0)
+		if err != nil {
+			l.fail(m.Mint.String(), err)
+			continue
+		}
+		l.fileDataIn <- &collectionFile{mint: m.Mint.String(), metadata: f}
+	}
 }
 
-// Downloads required files & passes to `mediaWorker`
+// Stores the metadata, downloads & resizes the image & passes to `mediaWorker`
 func (l *collectionLoader) fileDataWorker() {
-	return
+	for f := range l.fileDataIn {
+		media, err := l.solImg.Store(f.mint, f.metadata)
+		if err != nil {
+			l.fail(f.mint, err)
+			continue
+		}
+
+		err = l.img.CacheImage(l.ctx, media)
+		if err != nil {
+			l.fail(f.mint, err)
+			continue
+		}
+		l.mediaIn <- media
+	}
 }
 
-// Stores media data down to SQL with proper error handling
+// Records completed media to the checkpoint so a rerun can resume
 func (l *collectionLoader) mediaWorker() {
-	for {
-		select {
-		case m := <-l.mediaIn:
-			if err := l.saveMedia(m); err != nil {
-				log.Printf("Failed to save media: %v", err)
-			}
-		case <-l.done:
-			return
+	for m := range l.mediaIn {
+		if err := l.saveMedia(m); err != nil {
+			log.Printf("Failed to save media: %v", err)
 		}
 	}
 }
@@ -103,7 +275,76 @@ func (l *collectionLoader) saveMedia(m *nft_proxy.Media) error {
 	if m == nil {
 		return errors.New("nil media object")
 	}
-	log.Printf("Saving media: %s", m.MediaUri)
-	// TODO: Implement actual DB save
+
+	err := l.checkpoint.Add(m.Mint)
+	if err != nil {
+		return err
+	}
+
+	n := atomic.AddUint64(&l.loaded, 1)
+	if n%100 == 0 {
+		log.Printf("Loaded %v mints", n)
+	}
 	return nil
 }
+
+func (l *collectionLoader) fail(mint string, err error) {
+	atomic.AddUint64(&l.failed, 1)
+	log.Printf("%s failed: %s", mint, err)
+}
+
+// checkpoint is an append only list of completed mints, each line is synced so a crash loses at most one mint
+type checkpoint struct {
+	mu   sync.Mutex
+	f    *os.File
+	done map[string]struct{}
+}
+
+func openCheckpoint(path string) (*checkpoint, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpoint{f: f, done: map[string]struct{}{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if mint := strings.TrimSpace(scanner.Text()); mint != "" {
+			cp.done[mint] = struct{}{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return cp, nil
+}
+
+func (cp *checkpoint) Has(mint string) bool {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, ok := cp.done[mint]
+	return ok
+}
+
+func (cp *checkpoint) Len() int {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	return len(cp.done)
+}
+
+func (cp *checkpoint) Add(mint string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if _, err := cp.f.WriteString(mint + "\n"); err != nil {
+		return err
+	}
+	cp.done[mint] = struct{}{}
+	return cp.f.Sync()
+}
+
+func (cp *checkpoint) Close() error {
+	return cp.f.Close()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	gocontext "context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	services "github.com/alphabatem/nft-proxy/service"
+	"github.com/babilu-online/common/context"
+	"github.com/joho/godotenv"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: go run cli/migrate.go [-to version] status|up|down|backfill")
+		fmt.Fprintln(os.Stderr, "  backfill fills columns derived from cached images for rows stored before they existed, run it after up.")
+		fmt.Fprintln(os.Stderr, "  Cached files are renamed to their real type, so stop the server first")
+		flag.PrintDefaults()
+	}
+	to := flag.Int("to", -1, "Target version, up defaults to the latest & down to the previous version")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Printf("No .env file loaded: %s", err)
+	}
+
+	cfg, err := services.LoadConfig(nil)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
+	driver := cfg.DB.Driver
+	store, err := services.StorageFromConfig(cfg.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := store.Open(); err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	version, err := store.SchemaVersion()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch flag.Arg(0) {
+	case "status":
+		err = printStatus(store)
+	case "up":
+		target := *to
+		if target < 0 {
+			target = services.LatestMigration()
+		}
+		if target < version {
+			log.Fatalf("Database is at version %v, use down to go back to %v", version, target)
+		}
+		if target == version {
+			log.Printf("Database is already at version %v", version)
+			return
+		}
+		log.Printf("Migrating %s database from version %v to %v", driver, version, target)
+		err = store.MigrateUp(target)
+	case "down":
+		target := *to
+		if target < 0 {
+			target = version - 1
+		}
+		if target < 0 || target > version {
+			log.Fatalf("Database is at version %v, cannot migrate down to %v", version, target)
+		}
+		log.Printf("Rolling back %s database from version %v to %v", driver, version, target)
+		err = store.MigrateDown(target)
+	case "backfill":
+		if version != services.LatestMigration() {
+			log.Fatalf("Database is at version %v, run up before backfilling", version)
+		}
+		err = runBackfill()
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// runBackfill sniffs the type of cached images stored before types were detected, then derives any missing image properties.
+// Types go first as reconciling can rename the cached file the properties are read from
+func runBackfill() error {
+	ctx, err := context.NewCtx(
+		&services.ConfigService{},
+		&services.StorageService{},
+		&services.BlocklistService{},
+		&services.ResizeService{},
+		&services.SolanaService{},
+		&services.SolanaImageService{},
+		&services.CacheService{Passive: true},
+		&services.ImageService{},
+	)
+	if err != nil {
+		return fmt.Errorf("failed to initialize context: %w", err)
+	}
+	if err := ctx.Run(); err != nil {
+		return fmt.Errorf("failed to run context: %w", err)
+	}
+	img := ctx.Service(services.IMG_SVC).(*services.ImageService)
+
+	runCtx, stop := signal.NotifyContext(gocontext.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Reconciling cached image types")
+	reconciled, err := img.ReconcileImageTypes(runCtx)
+	log.Printf("Reconciled %v cached images", reconciled)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Backfilling image properties")
+	analyzed, err := img.BackfillImageProperties(runCtx)
+	log.Printf("Analyzed %v cached images", analyzed)
+	return err
+}
+
+func printStatus(store services.Storage) error {
+	status, err := store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+	for _, m := range status {
+		applied := "pending"
+		if m.AppliedAt != nil {
+			applied = m.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%v\t%s\t%s\n", m.Version, m.Name, applied)
+	}
+	return w.Flush()
+}
@@ -1,47 +1,111 @@
 package main
 
 import (
+	gocontext "context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	nft_proxy "github.com/alphabatem/nft-proxy"
 	services "github.com/alphabatem/nft-proxy/service"
 	"github.com/babilu-online/common/context"
 	"github.com/joho/godotenv"
 )
 
+const (
+	ModeDelete   = "delete"   // Remove the cached rows so they are refetched on next request
+	ModeMetadata = "metadata" // Refetch on-chain & off-chain metadata
+	ModeImages   = "images"   // Refetch & resize images
+	ModeWarm     = "warm"     // Request each mint from a remote proxy to warm its cache
+
+	// deleteBatchSize keeps IN clauses well below SQLite's bound parameter limit
+	deleteBatchSize = 500
+)
+
 // Config holds application configuration
 type Config struct {
 	HashlistPath string
 	APIEndpoint  string
 	WorkerCount  int
+	Mode         string
+	DryRun       bool
+	ReportPath   string
+	ReportFormat string
+	Timeout      time.Duration
 }
 
 // Hashlist represents a collection of NFT hashes
 type Hashlist []string
 
+// Result is the per-mint outcome written to the report
+type Result struct {
+	Mint     string `json:"mint"`
+	Action   string `json:"action"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration int64  `json:"durationMs"`
+}
+
 func loadConfig() (*Config, error) {
-	if err := godotenv.Load(); err != nil {
-		return nil, fmt.Errorf("error loading .env file: %w", err)
+	cfg := &Config{}
+	flag.StringVar(&cfg.HashlistPath, "hashlist", "./hashlist.json", "Path to a JSON array of mints")
+	flag.StringVar(&cfg.Mode, "mode", ModeDelete, "delete, metadata, images or warm")
+	flag.StringVar(&cfg.APIEndpoint, "url", "", "URL template for warm mode, %s is replaced with the mint (e.g. https://host/v1/nfts/%s/image.jpg)")
+	flag.IntVar(&cfg.WorkerCount, "concurrency", 5, "Mints processed concurrently")
+	flag.BoolVar(&cfg.DryRun, "dry-run", false, "Report what would be done without changing anything")
+	flag.StringVar(&cfg.ReportPath, "report", "", "Write a per-mint report to this path, - for stdout")
+	flag.StringVar(&cfg.ReportFormat, "report-format", "json", "Report format, json or csv")
+	flag.DurationVar(&cfg.Timeout, "timeout", services.DefaultConfig().Image.FetchTimeout.Duration(), "Per mint request timeout in warm mode, cold mints are fetched & resized before responding")
+	flag.Parse()
+
+	switch cfg.Mode {
+	case ModeDelete, ModeMetadata, ModeImages:
+	case ModeWarm:
+		if cfg.APIEndpoint == "" {
+			return nil, errors.New("-url is required in warm mode")
+		}
+		if strings.Count(cfg.APIEndpoint, "%s") != 1 || strings.Contains(fmt.Sprintf(cfg.APIEndpoint, "mint"), "%!") {
+			return nil, fmt.Errorf("-url must contain a single %%s for the mint & no other verbs (escape a literal %% as %%%%), got %q", cfg.APIEndpoint)
+		}
+		if cfg.Timeout <= 0 {
+			return nil, errors.New("timeout must be positive")
+		}
+	default:
+		return nil, fmt.Errorf("invalid mode: %s", cfg.Mode)
 	}
 
-	return &Config{
-		HashlistPath: "./hashlist.json",
-		APIEndpoint:  "https://api.degencdn.com/v1/nfts/%s/image.jpg",
-		WorkerCount:  5,
-	}, nil
+	if cfg.ReportFormat != "json" && cfg.ReportFormat != "csv" {
+		return nil, fmt.Errorf("invalid report format: %s", cfg.ReportFormat)
+	}
+	if cfg.WorkerCount < 1 {
+		return nil, errors.New("concurrency must be at least 1")
+	}
+
+	if err := godotenv.Load(); err != nil && cfg.Mode != ModeWarm {
+		log.Printf("No .env file loaded: %s", err)
+	}
+
+	return cfg, nil
 }
 
 func initializeContext() (*context.Context, error) {
 	mainContext, err := context.NewCtx(
-		&services.SqliteService{},
+		&services.ConfigService{},
+		&services.StorageService{},
+		&services.BlocklistService{},
 		&services.SolanaImageService{},
+		&services.CacheService{Passive: true},
 		&services.ImageService{},
 		&services.ResizeService{},
 		&services.SolanaService{},
@@ -63,133 +127,210 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	ctx, err := initializeContext()
+	hashes, err := loadHashlist(cfg.HashlistPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize context: %v", err)
+		log.Fatalf("Failed to load hashlist: %v", err)
+	}
+	log.Printf("Processing %d mints (mode: %s, dry run: %v)", len(hashes), cfg.Mode, cfg.DryRun)
+
+	var ctx *context.Context
+	if cfg.Mode != ModeWarm {
+		ctx, err = initializeContext()
+		if err != nil {
+			log.Fatalf("Failed to initialize context: %v", err)
+		}
 	}
 
-	if err := run(ctx, cfg); err != nil {
+	//Interrupts cancel in-flight mints, those not yet started are reported as failed
+	runCtx, stop := signal.NotifyContext(gocontext.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	results, err := run(runCtx, ctx, cfg, hashes)
+	if err != nil {
 		log.Fatalf("Application error: %v", err)
 	}
-}
 
-func run(ctx *context.Context, cfg *Config) error {
-	db := ctx.Service(services.SQLITE_SVC).(*services.SqliteService)
+	if err := writeReport(cfg, results); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
 
-	hashes, err := loadHashlist(cfg.HashlistPath)
-	if err != nil {
-		return fmt.Errorf("failed to load hashlist: %w", err)
+	failed := 0
+	for _, r := range results {
+		if r.Status == "error" {
+			failed++
+		}
 	}
+	log.Printf("Processed %d mints, %d failed", len(results), failed)
+}
 
-	log.Printf("Processing %d mints", len(hashes))
+func run(runCtx gocontext.Context, ctx *context.Context, cfg *Config, hashes Hashlist) ([]*Result, error) {
+	switch cfg.Mode {
+	case ModeDelete:
+		return deleteExistingRecords(ctx.Service(services.STORAGE_SVC).(*services.StorageService), hashes, cfg.DryRun)
+	case ModeMetadata:
+		return reloadLocally(runCtx, ctx.Service(services.SOLANA_IMG_SVC).(*services.SolanaImageService), hashes, cfg), nil
+	case ModeImages:
+		return reloadImages(runCtx, ctx.Service(services.IMG_SVC).(*services.ImageService), hashes, cfg), nil
+	case ModeWarm:
+		return reloadRemote(runCtx, hashes, cfg), nil
+	}
+	return nil, fmt.Errorf("invalid mode: %s", cfg.Mode)
+}
 
-	// Get initial count
-	var count int64
-	if err := db.Db().Model(&nft_proxy.SolanaMedia{}).Count(&count).Error; err != nil {
-		return fmt.Errorf("failed to get initial count: %w", err)
+// deleteExistingRecords removes the rows for the hashlist in batches, reporting which mints were present
+func deleteExistingRecords(db *services.StorageService, hashes Hashlist, dryRun bool) ([]*Result, error) {
+	count, err := db.CountMedia()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get initial count: %w", err)
 	}
 	log.Printf("Initial record count: %d", count)
 
-	// Delete existing records
-	if err := deleteExistingRecords(db, hashes); err != nil {
-		return fmt.Errorf("failed to delete existing records: %w", err)
+	results := make([]*Result, 0, len(hashes))
+	for start := 0; start < len(hashes); start += deleteBatchSize {
+		batch := hashes[start:min(start+deleteBatchSize, len(hashes))]
+		started := time.Now()
+
+		existing, err := db.ExistingMints([]string(batch))
+		if err != nil {
+			return results, fmt.Errorf("failed to find existing records: %w", err)
+		}
+
+		status := "deleted"
+		if dryRun {
+			status = "dry-run"
+		} else if err := db.DeleteMedia(existing...); err != nil {
+			return results, fmt.Errorf("failed to delete existing records: %w", err)
+		}
+
+		found := make(map[string]struct{}, len(existing))
+		for _, m := range existing {
+			found[m] = struct{}{}
+		}
+		elapsed := time.Since(started).Milliseconds()
+		for _, h := range batch {
+			r := &Result{Mint: h, Action: ModeDelete, Status: status, Duration: elapsed}
+			if _, ok := found[h]; !ok {
+				r.Status = "not_found"
+			}
+			results = append(results, r)
+		}
 	}
 
-	// Get final count
-	if err := db.Db().Model(&nft_proxy.SolanaMedia{}).Count(&count).Error; err != nil {
-		return fmt.Errorf("failed to get final count: %w", err)
+	count, err = db.CountMedia()
+	if err != nil {
+		return results, fmt.Errorf("failed to get final count: %w", err)
 	}
 	log.Printf("Final record count: %d", count)
 
-	return nil
+	return results, nil
 }
 
-func deleteExistingRecords(db *services.SqliteService, hashes Hashlist) error {
-	if len(hashes) == 0 {
+func reloadRemote(ctx gocontext.Context, hashes Hashlist, cfg *Config) []*Result {
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	return forEachMint(ctx, hashes, cfg, ModeWarm, func(ctx gocontext.Context, h string) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf(cfg.APIEndpoint, h), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(io.Discard, resp.Body)
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
 		return nil
-	}
+	})
+}
 
-	query := `mint IN ("` + strings.Join(hashes, `","`) + `")`
-	return db.Db().Where(query).Delete(&nft_proxy.SolanaMedia{}).Error
+func reloadLocally(ctx gocontext.Context, img *services.SolanaImageService, hashes Hashlist, cfg *Config) []*Result {
+	return forEachMint(ctx, hashes, cfg, ModeMetadata, func(ctx gocontext.Context, h string) error {
+		_, err := img.Media(ctx, h, true)
+		return err
+	})
 }
 
-func reloadRemote(hashes Hashlist, cfg *Config) error {
-	client := &http.Client{Timeout: 5 * time.Second}
+func reloadImages(ctx gocontext.Context, img *services.ImageService, hashes Hashlist, cfg *Config) []*Result {
+	return forEachMint(ctx, hashes, cfg, ModeImages, func(ctx gocontext.Context, h string) error {
+		return img.ClearCache(ctx, h)
+	})
+}
+
+// forEachMint runs the action for every mint with at most cfg.WorkerCount in flight, results keep hashlist order
+func forEachMint(ctx gocontext.Context, hashes Hashlist, cfg *Config, action string, fn func(ctx gocontext.Context, h string) error) []*Result {
+	results := make([]*Result, len(hashes))
 	var wg sync.WaitGroup
-	errors := make(chan error, len(hashes))
 	semaphore := make(chan struct{}, cfg.WorkerCount)
 
-	for _, hash := range hashes {
+	for i, hash := range hashes {
+		if cfg.DryRun {
+			results[i] = &Result{Mint: hash, Action: action, Status: "dry-run"}
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			results[i] = &Result{Mint: hash, Action: action, Status: "error", Error: err.Error()}
+			continue
+		}
+
 		wg.Add(1)
 		semaphore <- struct{}{} // Acquire semaphore
 
-		go func(h string) {
+		go func(i int, h string) {
 			defer wg.Done()
 			defer func() { <-semaphore }() // Release semaphore
 
-			url := fmt.Sprintf(cfg.APIEndpoint, h)
-			resp, err := client.Get(url)
-			if err != nil {
-				errors <- fmt.Errorf("failed to load hash %s: %w", h, err)
-				return
+			started := time.Now()
+			r := &Result{Mint: h, Action: action, Status: "ok"}
+			if err := fn(ctx, h); err != nil {
+				r.Status = "error"
+				r.Error = err.Error()
 			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode != http.StatusOK {
-				errors <- fmt.Errorf("failed to load hash %s: status %d", h, resp.StatusCode)
-			}
-		}(hash)
+			r.Duration = time.Since(started).Milliseconds()
+			results[i] = r
+		}(i, hash)
 	}
 
 	wg.Wait()
-	close(errors)
-
-	// Collect errors
-	var errs []error
-	for err := range errors {
-		errs = append(errs, err)
-	}
-
-	if len(errs) > 0 {
-		return fmt.Errorf("encountered %d errors during reload", len(errs))
-	}
-
-	return nil
+	return results
 }
 
-func reloadLocally(img *services.SolanaImageService, hashes Hashlist, cfg *Config) error {
-	var wg sync.WaitGroup
-	errors := make(chan error, len(hashes))
-	semaphore := make(chan struct{}, cfg.WorkerCount)
-
-	for _, hash := range hashes {
-		wg.Add(1)
-		semaphore <- struct{}{} // Acquire semaphore
-
-		go func(h string) {
-			defer wg.Done()
-			defer func() { <-semaphore }() // Release semaphore
-
-			if _, err := img.Media(h, true); err != nil {
-				errors <- fmt.Errorf("failed to load media for hash %s: %w", h, err)
-			}
-		}(hash)
+func writeReport(cfg *Config, results []*Result) error {
+	if cfg.ReportPath == "" {
+		return nil
 	}
 
-	wg.Wait()
-	close(errors)
-
-	// Collect errors
-	var errs []error
-	for err := range errors {
-		errs = append(errs, err)
+	var out io.Writer = os.Stdout
+	if cfg.ReportPath != "-" {
+		f, err := os.Create(cfg.ReportPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
 	}
 
-	if len(errs) > 0 {
-		return fmt.Errorf("encountered %d errors during reload", len(errs))
+	if cfg.ReportFormat == "csv" {
+		w := csv.NewWriter(out)
+		if err := w.Write([]string{"mint", "action", "status", "error", "durationMs"}); err != nil {
+			return err
+		}
+		for _, r := range results {
+			err := w.Write([]string{r.Mint, r.Action, r.Status, r.Error, strconv.FormatInt(r.Duration, 10)})
+			if err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
 	}
 
-	return nil
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(results)
 }
 
 func loadHashlist(location string) (Hashlist, error) {
@@ -3,7 +3,8 @@ package nft_proxy
 import "github.com/gagliardetto/solana-go"
 
 const (
-	BASE64_PREFIX = ";base64,"
+	BASE64_PREFIX   = ";base64,"
+	DATA_URI_PREFIX = "data:"
 )
 
 var (
@@ -1,20 +1,37 @@
 package nft_proxy
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type Media struct {
-	ID              uint      `json:"-" gorm:"primaryKey"`
-	Mint            string    `json:"mint" gorm:"uniqueIndex"`
-	MintDecimals    uint8     `json:"decimals"`
-	ImageUri        string    `json:"imageUri"`
-	ImageType       string    `json:"imageType"`
-	MediaUri        string    `json:"mediaUri,omitempty"`
-	MediaType       string    `json:"mediaType,omitempty"`
-	LocalPath       string    `json:"-"`
-	Name            string    `json:"name,omitempty"`
-	Symbol          string    `json:"symbol,omitempty"`
-	UpdateAuthority string    `json:"updateAuthority,omitempty"`
-	CreatedAt       time.Time `json:"-"`
+	ID              uint           `json:"-" gorm:"primaryKey"`
+	Mint            string         `json:"mint" gorm:"uniqueIndex"`
+	MintDecimals    uint8          `json:"decimals"`
+	ImageUri        string         `json:"imageUri"`
+	ImageType       string         `json:"imageType"`
+	MediaUri        string         `json:"mediaUri,omitempty"`
+	MediaType       string         `json:"mediaType,omitempty"`
+	Animated        bool           `json:"animated"`
+	BlurHash        string         `json:"blurHash,omitempty"`
+	DominantColor   string         `json:"dominantColor,omitempty"`
+	Palette         []string       `json:"palette,omitempty"`
+	PHash           string         `json:"pHash,omitempty"`
+	LocalPath       string         `json:"-"`
+	Name            string         `json:"name,omitempty"`
+	Symbol          string         `json:"symbol,omitempty"`
+	UpdateAuthority string         `json:"updateAuthority,omitempty"`
+	Collection      string         `json:"collection,omitempty"`
+	Blocked         bool           `json:"blocked"`
+	Variants        []ImageVariant `json:"variants,omitempty" gorm:"-"`
+	CreatedAt       time.Time      `json:"-"`
+}
+
+// ImageVariant is a resized copy of the image, listed so clients can build a srcset
+type ImageVariant struct {
+	Size int    `json:"size"` //Height in pixels
+	Url  string `json:"url"`
 }
 
 type SolanaMedia struct {
@@ -23,28 +40,67 @@ type SolanaMedia struct {
 	MintDecimals    uint8     `json:"decimals"`
 	ImageUri        string    `json:"imageUri"`
 	ImageType       string    `json:"ImageType"`
+	DetectedType    string    `json:"detectedType"`
 	MediaUri        string    `json:"mediaUri"`
 	MediaType       string    `json:"mediaType"`
+	Animated        bool      `json:"animated"`
+	BlurHash        string    `json:"blurHash"`
+	DominantColor   string    `json:"dominantColor"`
+	Palette         string    `json:"palette"` //Comma separated hex colors
+	PHash           string    `json:"pHash"`   //Hex encoded 64 bit dHash
 	LocalPath       string    `json:"-"`
 	Name            string    `json:"name"`
 	Symbol          string    `json:"symbol"`
 	UpdateAuthority string    `json:"updateAuthority"`
+	Collection      string    `json:"collection"`
 	CreatedAt       time.Time `json:"-"`
 }
 
 func (m *SolanaMedia) Media() *Media {
+	imageType := m.ImageType
+	if m.DetectedType != "" {
+		imageType = m.DetectedType
+	}
+
+	var palette []string
+	if m.Palette != "" {
+		palette = strings.Split(m.Palette, ",")
+	}
+
 	return &Media{
 		ID:              m.ID,
 		Mint:            m.Mint,
 		MintDecimals:    m.MintDecimals,
 		ImageUri:        m.ImageUri,
-		ImageType:       m.ImageType,
+		ImageType:       imageType,
 		MediaUri:        m.MediaUri,
 		MediaType:       m.MediaType,
+		Animated:        m.Animated,
+		BlurHash:        m.BlurHash,
+		DominantColor:   m.DominantColor,
+		Palette:         palette,
+		PHash:           m.PHash,
 		LocalPath:       m.LocalPath,
 		Name:            m.Name,
 		Symbol:          m.Symbol,
 		UpdateAuthority: m.UpdateAuthority,
+		Collection:      m.Collection,
 		CreatedAt:       m.CreatedAt,
 	}
 }
+
+// MediaHashBand indexes one 8 bit band of a media perceptual hash so near duplicates can be found with an index lookup
+type MediaHashBand struct {
+	Mint  string `gorm:"primaryKey"`
+	Band  uint8  `gorm:"primaryKey;index:idx_hash_band_value,priority:1"`
+	Value uint8  `gorm:"index:idx_hash_band_value,priority:2"`
+}
+
+type SimilarMedia struct {
+	Mint            string `json:"mint"`
+	Name            string `json:"name,omitempty"`
+	UpdateAuthority string `json:"updateAuthority,omitempty"`
+	BlurHash        string `json:"blurHash,omitempty"`
+	PHash           string `json:"pHash"`
+	Distance        int    `json:"distance"`
+}
@@ -12,6 +12,7 @@ type NFTMetadataSimple struct {
 	Properties      NFTPropertiesSimple `json:"properties"`
 	Files           []NFTFiles          `json:"files"`
 	UpdateAuthority string              `json:"updateAuthority"`
+	CollectionKey   string              `json:"-"` //Verified on-chain collection
 }
 
 func (m *NFTMetadataSimple) AnimationFile() *NFTFiles {
@@ -2,29 +2,41 @@ package main
 
 import (
 	"log"
+	"os"
 
 	services "github.com/alphabatem/nft-proxy/service"
 	"github.com/babilu-online/common/context"
 	"github.com/joho/godotenv"
 )
 
+// LoadEnvironment loads .env when present, the config can come entirely from a file, the environment & flags
 func LoadEnvironment() {
 	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("Error loading .env file: %s", err)
 	}
 }
 
 func main() {
 	LoadEnvironment()
 
+	cfg, err := services.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%s", err)
+	}
+
 	ctx, err := context.NewCtx(
-		&services.SqliteService{},
+		&services.ConfigService{Config: cfg},
+		&services.TracingService{},
+		&services.StorageService{},
+		&services.BlocklistService{},
 		&services.StatService{},
 		&services.ResizeService{},
 		&services.SolanaService{},
 		&services.SolanaImageService{},
+		&services.CacheService{},
 		&services.ImageService{},
+		&services.HealthService{},
 		&services.HttpService{},
 	)
 
@@ -33,6 +45,10 @@ func main() {
 		return
 	}
 
+	//Blocks until the http server has shut down & drained
 	err = ctx.Run()
-	log.Fatal(err)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Shutdown complete")
 }
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+	"github.com/babilu-online/common/context"
+)
+
+// BlocklistService keeps moderated mints, collections & update authorities in memory so lookups dont hit the DB.
+// Entries are persisted & periodically reloaded so changes made on one replica reach the others
+type BlocklistService struct {
+	context.DefaultService
+
+	store *StorageService
+
+	mu      sync.RWMutex
+	entries map[nft_proxy.BlockKind]map[string]struct{}
+
+	replacementImage []byte
+	replacementType  string
+
+	stop chan struct{}
+}
+
+const BLOCKLIST_SVC = "blocklist_svc"
+
+// blocklistReloadInterval controls how quickly changes made on other replicas are picked up
+const blocklistReloadInterval = time.Minute
+
+var ErrInvalidBlockKind = errors.New("invalid block kind")
+
+func (svc *BlocklistService) Id() string {
+	return BLOCKLIST_SVC
+}
+
+func (svc *BlocklistService) Start() error {
+	svc.store = svc.Service(STORAGE_SVC).(*StorageService)
+
+	var err error
+	svc.replacementImage, err = os.ReadFile(svc.Service(CONFIG_SVC).(*ConfigService).Config.Image.BlockedImage)
+	if err != nil {
+		return fmt.Errorf("image.blocked_image (BLOCKED_IMAGE): %w", err)
+	}
+	svc.replacementType = http.DetectContentType(svc.replacementImage)
+
+	err = svc.reload()
+	if err != nil {
+		return err
+	}
+
+	svc.stop = make(chan struct{})
+	go svc.reloadLoop()
+
+	return nil
+}
+
+func (svc *BlocklistService) Shutdown() {
+	if svc.stop != nil {
+		close(svc.stop)
+	}
+}
+
+// IsBlocked checks the mint, collection & update authority of the media against the blocklist
+func (svc *BlocklistService) IsBlocked(media *nft_proxy.Media) bool {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	return svc.contains(nft_proxy.BlockKindMint, media.Mint) ||
+		svc.contains(nft_proxy.BlockKindCollection, media.Collection) ||
+		svc.contains(nft_proxy.BlockKindUpdateAuthority, media.UpdateAuthority)
+}
+
+// ReplacementImage returns the image served in place of blocked media & its content type
+func (svc *BlocklistService) ReplacementImage() ([]byte, string) {
+	return svc.replacementImage, svc.replacementType
+}
+
+// List returns all blocklist entries
+func (svc *BlocklistService) List() ([]*nft_proxy.BlockedMedia, error) {
+	return svc.store.BlockedMedia()
+}
+
+// Add blocks a mint, collection or update authority, updating the reason if its already blocked
+func (svc *BlocklistService) Add(entry *nft_proxy.BlockedMedia) error {
+	if !entry.Kind.Valid() {
+		return ErrInvalidBlockKind
+	}
+	if entry.Key == "" {
+		return errors.New("missing key")
+	}
+
+	err := svc.store.SaveBlocked(entry)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	svc.entries[entry.Kind][entry.Key] = struct{}{}
+	svc.mu.Unlock()
+	return nil
+}
+
+// Remove unblocks a mint, collection or update authority
+func (svc *BlocklistService) Remove(kind nft_proxy.BlockKind, key string) error {
+	if !kind.Valid() {
+		return ErrInvalidBlockKind
+	}
+
+	err := svc.store.DeleteBlocked(kind, key)
+	if err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	delete(svc.entries[kind], key)
+	svc.mu.Unlock()
+	return nil
+}
+
+func (svc *BlocklistService) contains(kind nft_proxy.BlockKind, key string) bool {
+	if key == "" {
+		return false
+	}
+	_, ok := svc.entries[kind][key]
+	return ok
+}
+
+func (svc *BlocklistService) reload() error {
+	rows, err := svc.store.BlockedMedia()
+	if err != nil {
+		return fmt.Errorf("failed to load blocklist: %w", err)
+	}
+
+	entries := map[nft_proxy.BlockKind]map[string]struct{}{}
+	for _, kind := range nft_proxy.BlockKinds {
+		entries[kind] = map[string]struct{}{}
+	}
+	for _, r := range rows {
+		if _, ok := entries[r.Kind]; ok {
+			entries[r.Kind][r.Key] = struct{}{}
+		}
+	}
+
+	svc.mu.Lock()
+	svc.entries = entries
+	svc.mu.Unlock()
+	return nil
+}
+
+func (svc *BlocklistService) reloadLoop() {
+	ticker := time.NewTicker(blocklistReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := svc.reload(); err != nil {
+				Logger(LOG_BLOCKLIST).Error("Blocklist reload failed", "err", err)
+			}
+		case <-svc.stop:
+			return
+		}
+	}
+}
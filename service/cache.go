@@ -0,0 +1,397 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/babilu-online/common/context"
+)
+
+// CacheService keeps the image cache within its disk quota, evicting the least recently served files first.
+// Access times are tracked in memory & periodically persisted to the cache dir so they survive restarts.
+// The hottest images are also held in memory so they can be served without disk or DB access
+type CacheService struct {
+	context.DefaultService
+
+	//Passive caches only record the files they write, for processes sharing the cache dir with a server.
+	//Eviction & access times are left to the server, which knows what its serving
+	Passive bool
+
+	cfg    CacheConfig
+	logger *slog.Logger
+
+	hot *imageLRU
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry //Keyed by file name within the cache dir
+	size    int64
+	dirty   bool //Access times changed since the last flush
+
+	evictions    uint64
+	evictedBytes uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+type cacheEntry struct {
+	size     int64
+	accessed int64 //Unix seconds
+	serving  int   //Open readers, the file cant be evicted while > 0
+}
+
+const CACHE_SVC = "cache_svc"
+
+// cacheAccessFile stores the access times within the cache dir, dot files are never evicted
+const cacheAccessFile = ".access.json"
+
+// cacheTempPrefix names files being written, theyre renamed into place once complete.
+// Temp files older than cacheTempMaxAge were left by a crash & are removed by the scan
+const cacheTempPrefix = ".tmp-"
+
+const cacheTempMaxAge = time.Hour
+
+// cacheLowWater is the fraction of the quota eviction frees down to, so each pass makes room for more than one file
+const cacheLowWater = 0.9
+
+func (svc *CacheService) Id() string {
+	return CACHE_SVC
+}
+
+func (svc *CacheService) Start() error {
+	svc.cfg = svc.Service(CONFIG_SVC).(*ConfigService).Config.Cache
+	svc.logger = Logger(LOG_CACHE)
+
+	if err := svc.open(); err != nil {
+		return err
+	}
+	if svc.Passive {
+		return nil
+	}
+
+	svc.stop = make(chan struct{})
+	svc.done = make(chan struct{})
+	go svc.loop()
+
+	return nil
+}
+
+// Shutdown stops the evictor & persists the latest access times
+func (svc *CacheService) Shutdown() {
+	if svc.stop == nil {
+		return
+	}
+	close(svc.stop)
+	<-svc.done
+}
+
+// open loads the persisted access times & sizes the cache dir
+func (svc *CacheService) open() error {
+	if err := os.MkdirAll(svc.cfg.Dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir: %w", err)
+	}
+
+	svc.hot = newImageLRU(int64(svc.cfg.MemoryMB) << 20)
+	svc.entries = map[string]*cacheEntry{}
+	if err := svc.loadAccessTimes(); err != nil {
+		svc.logger.Warn("Loading cache access times failed", "err", err)
+	}
+	return svc.scan()
+}
+
+// Acquire records an access & protects the file from eviction until the returned release is called
+func (svc *CacheService) Acquire(path string) (release func()) {
+	svc.mu.Lock()
+	e := svc.entry(filepath.Base(path))
+	e.serving++
+	e.accessed = time.Now().Unix()
+	svc.dirty = true
+	svc.mu.Unlock()
+
+	return func() {
+		svc.mu.Lock()
+		e.serving--
+		svc.mu.Unlock()
+	}
+}
+
+// Stored records a file written to the cache so the size is current before the next scan
+func (svc *CacheService) Stored(path string) {
+	ifo, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	e := svc.entry(filepath.Base(path))
+	svc.size += ifo.Size() - e.size
+	e.size = ifo.Size()
+	e.accessed = time.Now().Unix()
+	svc.dirty = true
+}
+
+// Touch records an access to a cached file served from memory, so its kept on disk for when its displaced
+func (svc *CacheService) Touch(path string) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if e, ok := svc.entries[filepath.Base(path)]; ok {
+		e.accessed = time.Now().Unix()
+		svc.dirty = true
+	}
+}
+
+// HotImage returns the in memory image stored under key
+func (svc *CacheService) HotImage(key string) (*CachedImage, bool) {
+	return svc.hot.Get(key)
+}
+
+// KeepHot holds the image in memory under key, displacing the least recently served images if full
+func (svc *CacheService) KeepHot(key string, img *CachedImage) {
+	svc.hot.Add(key, img)
+}
+
+// DropHot removes the in memory image stored under key, for when the file its read from is replaced
+func (svc *CacheService) DropHot(key string) {
+	svc.hot.Remove(key)
+}
+
+// Stats reports the cache size against the quota, how much has been evicted & the memory cache hit rate
+func (svc *CacheService) Stats() map[string]interface{} {
+	svc.mu.Lock()
+	stats := map[string]interface{}{
+		"cacheFiles":        len(svc.entries),
+		"cacheBytes":        svc.size,
+		"cacheQuotaBytes":   int64(svc.cfg.MaxSizeMB) << 20,
+		"cacheEvictions":    svc.evictions,
+		"cacheEvictedBytes": svc.evictedBytes,
+	}
+	svc.mu.Unlock()
+
+	for k, v := range svc.hot.Stats() {
+		stats[k] = v
+	}
+	return stats
+}
+
+// entry returns the entry for name, adding it if its not tracked yet. Must be called with mu held
+func (svc *CacheService) entry(name string) *cacheEntry {
+	e, ok := svc.entries[name]
+	if !ok {
+		e = &cacheEntry{}
+		svc.entries[name] = e
+	}
+	return e
+}
+
+func (svc *CacheService) loop() {
+	defer close(svc.done)
+
+	evict := time.NewTicker(svc.cfg.EvictInterval.Duration())
+	defer evict.Stop()
+	flush := time.NewTicker(svc.cfg.AccessFlushInterval.Duration())
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-evict.C:
+			if err := svc.scan(); err != nil {
+				svc.logger.Error("Scanning cache failed", "err", err)
+				continue
+			}
+			svc.evict()
+		case <-flush.C:
+			if err := svc.flushAccessTimes(); err != nil {
+				svc.logger.Error("Saving cache access times failed", "err", err)
+			}
+		case <-svc.stop:
+			if err := svc.flushAccessTimes(); err != nil {
+				svc.logger.Error("Saving cache access times failed", "err", err)
+			}
+			return
+		}
+	}
+}
+
+// scan sizes every file in the cache dir, picking up files written, renamed or removed outside of Stored.
+// Files without a recorded access are treated as last accessed when they were written
+func (svc *CacheService) scan() error {
+	dirEntries, err := os.ReadDir(svc.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	found := make(map[string]fs.FileInfo, len(dirEntries))
+	for _, d := range dirEntries {
+		if strings.HasPrefix(d.Name(), cacheTempPrefix) {
+			if ifo, err := d.Info(); err == nil && time.Since(ifo.ModTime()) > cacheTempMaxAge {
+				_ = os.Remove(filepath.Join(svc.cfg.Dir, d.Name()))
+			}
+			continue
+		}
+		if !d.Type().IsRegular() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		ifo, err := d.Info()
+		if err != nil {
+			continue //Removed since listing
+		}
+		found[d.Name()] = ifo
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	var size int64
+	for name, e := range svc.entries {
+		ifo, ok := found[name]
+		if !ok {
+			if e.serving == 0 {
+				delete(svc.entries, name)
+			}
+			continue
+		}
+		e.size = ifo.Size()
+		size += e.size
+		delete(found, name)
+	}
+	for name, ifo := range found {
+		svc.entries[name] = &cacheEntry{size: ifo.Size(), accessed: ifo.ModTime().Unix()}
+		size += ifo.Size()
+	}
+	svc.size = size
+
+	return nil
+}
+
+// evict removes the least recently accessed files until the cache is below the low water mark.
+// Each file is checked & removed under the lock so a request cant start serving it mid removal
+func (svc *CacheService) evict() {
+	quota := int64(svc.cfg.MaxSizeMB) << 20
+	if quota <= 0 {
+		return
+	}
+
+	svc.mu.Lock()
+	if svc.size <= quota {
+		svc.mu.Unlock()
+		return
+	}
+	names := make([]string, 0, len(svc.entries))
+	for name := range svc.entries {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return svc.entries[names[i]].accessed < svc.entries[names[j]].accessed
+	})
+	svc.mu.Unlock()
+
+	target := int64(float64(quota) * cacheLowWater)
+	var evicted int
+	var freed int64
+	for _, name := range names {
+		svc.mu.Lock()
+		if svc.size <= target {
+			svc.mu.Unlock()
+			break
+		}
+
+		e, ok := svc.entries[name]
+		if !ok || e.serving > 0 {
+			svc.mu.Unlock()
+			continue
+		}
+
+		err := os.Remove(filepath.Join(svc.cfg.Dir, name))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			svc.mu.Unlock()
+			svc.logger.Warn("Evicting cached file failed", "file", name, "err", err)
+			continue
+		}
+
+		delete(svc.entries, name)
+		svc.size -= e.size
+		svc.evictions++
+		svc.evictedBytes += uint64(e.size)
+		svc.dirty = true
+		evicted++
+		freed += e.size
+		svc.mu.Unlock()
+	}
+
+	if evicted > 0 {
+		svc.logger.Info("Evicted cached files", "files", evicted, "bytes", freed)
+	}
+}
+
+func (svc *CacheService) loadAccessTimes() error {
+	data, err := os.ReadFile(filepath.Join(svc.cfg.Dir, cacheAccessFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var accessed map[string]int64
+	if err := json.Unmarshal(data, &accessed); err != nil {
+		return err
+	}
+
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	for name, at := range accessed {
+		svc.entry(name).accessed = at
+	}
+	return nil
+}
+
+// flushAccessTimes writes the access times if any changed, via a rename so a crash cant leave a partial file
+func (svc *CacheService) flushAccessTimes() error {
+	svc.mu.Lock()
+	if !svc.dirty {
+		svc.mu.Unlock()
+		return nil
+	}
+	accessed := make(map[string]int64, len(svc.entries))
+	for name, e := range svc.entries {
+		accessed[name] = e.accessed
+	}
+	svc.dirty = false
+	svc.mu.Unlock()
+
+	data, err := json.Marshal(accessed)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(svc.cfg.Dir, cacheAccessFile+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(svc.cfg.Dir, cacheAccessFile))
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		svc.mu.Lock()
+		svc.dirty = true
+		svc.mu.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheEviction(t *testing.T) {
+	dir := t.TempDir()
+	svc := &CacheService{cfg: CacheConfig{Dir: dir, MaxSizeMB: 1}, logger: Logger(LOG_CACHE)}
+
+	//Four 300KB files, oldest first, puts the cache over its 1MB quota
+	names := []string{"a.jpg", "b.jpg", "c.jpg", "d.jpg"}
+	for i, name := range names {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, make([]byte, 300<<10), 0644); err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(time.Duration(i-len(names)) * time.Hour)
+		if err := os.Chtimes(path, at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := svc.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	release := svc.Acquire(filepath.Join(dir, "a.jpg")) //Oldest, but now being served
+	svc.evict()
+
+	for name, kept := range map[string]bool{"a.jpg": true, "b.jpg": false, "c.jpg": true, "d.jpg": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("%s: expected kept=%v, got err %v", name, kept, err)
+		}
+	}
+	release()
+
+	stats := svc.Stats()
+	if stats["cacheEvictions"] != uint64(1) || stats["cacheBytes"] != int64(900<<10) {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+
+	//Access times survive a restart, c is now the least recently used
+	if err := svc.flushAccessTimes(); err != nil {
+		t.Fatal(err)
+	}
+	restarted := &CacheService{cfg: svc.cfg, logger: svc.logger}
+	if err := restarted.open(); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Stored(filepath.Join(dir, "e.jpg")) //Missing files are ignored
+	if err := os.WriteFile(filepath.Join(dir, "e.jpg"), make([]byte, 300<<10), 0644); err != nil {
+		t.Fatal(err)
+	}
+	restarted.Stored(filepath.Join(dir, "e.jpg"))
+	restarted.evict()
+
+	if _, err := os.Stat(filepath.Join(dir, "c.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected c.jpg to be evicted, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.jpg")); err != nil {
+		t.Errorf("expected recently served a.jpg to be kept, got %v", err)
+	}
+}
+
+func TestImageLRU(t *testing.T) {
+	lru := newImageLRU(80)
+	img := func() *CachedImage { return &CachedImage{Data: make([]byte, 10)} }
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		lru.Add(key, img())
+	}
+	if _, ok := lru.Get("a"); !ok { //Now the most recently used
+		t.Fatal("expected a to be cached")
+	}
+	lru.Add("i", img())
+	lru.Add("large", &CachedImage{Data: make([]byte, 11)}) //Over an eighth of the capacity
+
+	for key, cached := range map[string]bool{"a": true, "b": false, "i": true, "large": false} {
+		if _, ok := lru.Get(key); ok != cached {
+			t.Errorf("%s: expected cached=%v", key, cached)
+		}
+	}
+
+	lru.Remove("a")
+	stats := lru.Stats()
+	if stats["memoryCacheBytes"] != int64(70) || stats["memoryCacheHits"] != uint64(3) || stats["memoryCacheMisses"] != uint64(2) {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+}
@@ -0,0 +1,495 @@
+package services
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/babilu-online/common/context"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the runtime configuration shared by every service.
+// Values are loaded from defaults, then a YAML/TOML file, then environment variables, then flags
+type Config struct {
+	HTTP   HTTPConfig   `yaml:"http" toml:"http"`
+	RPC    RPCConfig    `yaml:"rpc" toml:"rpc"`
+	DB     DBConfig     `yaml:"db" toml:"db"`
+	Cache  CacheConfig  `yaml:"cache" toml:"cache"`
+	Image  ImageConfig  `yaml:"image" toml:"image"`
+	Log    LogConfig    `yaml:"log" toml:"log"`
+	Trace  TraceConfig  `yaml:"trace" toml:"trace"`
+	Health HealthConfig `yaml:"health" toml:"health"`
+	Fetch  FetchConfig  `yaml:"fetch" toml:"fetch"`
+}
+
+type HTTPConfig struct {
+	Port            int      `yaml:"port" toml:"port"`
+	ReadTimeout     Duration `yaml:"read_timeout" toml:"read_timeout"`
+	WriteTimeout    Duration `yaml:"write_timeout" toml:"write_timeout"`
+	StreamTimeout   Duration `yaml:"stream_timeout" toml:"stream_timeout"` // Replaces write_timeout on routes streaming large media
+	IdleTimeout     Duration `yaml:"idle_timeout" toml:"idle_timeout"`
+	ShutdownTimeout Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	AdminToken      string   `yaml:"admin_token" toml:"admin_token"`
+	FailedImage     string   `yaml:"failed_image" toml:"failed_image"` // Served when an image cant be fetched
+	PublicURL       string   `yaml:"public_url" toml:"public_url"`     // Prefixed to image variant links, relative links when empty
+}
+
+type RPCConfig struct {
+	URL string `yaml:"url" toml:"url"`
+}
+
+type DBConfig struct {
+	Driver   string `yaml:"driver" toml:"driver"`     // sqlite or postgres
+	Database string `yaml:"database" toml:"database"` // SQLite file
+	DSN      string `yaml:"dsn" toml:"dsn"`           // Postgres connection string
+	Migrate  string `yaml:"migrate" toml:"migrate"`   // auto or manual
+}
+
+type CacheConfig struct {
+	Dir                 string   `yaml:"dir" toml:"dir"`
+	MaxSizeMB           int      `yaml:"max_size_mb" toml:"max_size_mb"`                     // Disk quota, least recently served files are evicted beyond it. 0 disables eviction
+	EvictInterval       Duration `yaml:"evict_interval" toml:"evict_interval"`               // How often the cache is sized & evicted
+	AccessFlushInterval Duration `yaml:"access_flush_interval" toml:"access_flush_interval"` // How often access times are persisted
+	MemoryMB            int      `yaml:"memory_mb" toml:"memory_mb"`                         // Hottest resized images kept in memory, 0 disables
+}
+
+type ImageConfig struct {
+	DefaultSize     int      `yaml:"default_size" toml:"default_size"`
+	Sizes           []int    `yaml:"sizes" toml:"sizes"` // Variants generated together from each download, the default size is always included
+	JPEGQuality     int      `yaml:"jpeg_quality" toml:"jpeg_quality"`
+	FetchTimeout    Duration `yaml:"fetch_timeout" toml:"fetch_timeout"`       // Image & media downloads
+	MetadataTimeout Duration `yaml:"metadata_timeout" toml:"metadata_timeout"` // Off-chain metadata JSON
+	BlockedImage    string   `yaml:"blocked_image" toml:"blocked_image"`       // Served in place of blocked media
+	MaxPixels       int      `yaml:"max_pixels" toml:"max_pixels"`             // Largest width x height decoded
+	MaxFrames       int      `yaml:"max_frames" toml:"max_frames"`             // Most frames decoded from an animated GIF
+	MaxGIFPixels    int      `yaml:"max_gif_pixels" toml:"max_gif_pixels"`     // Largest width x height x frames decoded from an animated GIF
+}
+
+// Duration is a time.Duration written as a string in config files (e.g. "30s")
+type Duration time.Duration
+
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d)
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	return d.UnmarshalText([]byte(s))
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// DefaultConfig returns the configuration used when nothing is overridden
+func DefaultConfig() *Config {
+	return &Config{
+		HTTP: HTTPConfig{
+			Port:            8080,
+			ReadTimeout:     Duration(15 * time.Second),
+			WriteTimeout:    Duration(60 * time.Second), // Covers the RPC lookup, download & resize of an uncached image
+			StreamTimeout:   Duration(30 * time.Minute), // Covers a max_media_mb file to a slow client
+			IdleTimeout:     Duration(120 * time.Second),
+			ShutdownTimeout: Duration(30 * time.Second),
+			FailedImage:     "./docs/failed_image.jpg",
+		},
+		RPC: RPCConfig{
+			URL: rpc.MainNetBeta_RPC,
+		},
+		DB: DBConfig{
+			Driver:   DB_DRIVER_SQLITE,
+			Database: "./nft_proxy.db",
+			Migrate:  "auto",
+		},
+		Cache: CacheConfig{
+			Dir:                 "./cache/solana",
+			MaxSizeMB:           10240,
+			EvictInterval:       Duration(time.Minute),
+			AccessFlushInterval: Duration(5 * time.Minute),
+			MemoryMB:            256,
+		},
+		Image: ImageConfig{
+			DefaultSize:     DefaultImageSize,
+			Sizes:           []int{64, 128, 256, 512, DefaultImageSize},
+			JPEGQuality:     DefaultJPEGQuality,
+			FetchTimeout:    Duration(10 * time.Second),
+			MetadataTimeout: Duration(5 * time.Second),
+			BlockedImage:    "./docs/failed_image.jpg",
+			MaxPixels:       DefaultMaxPixels,
+			MaxFrames:       DefaultMaxFrames,
+			MaxGIFPixels:    DefaultMaxGIFPixels,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Fetch: FetchConfig{
+			MaxBodyMB:    25,
+			MaxMediaMB:   200,
+			MaxRedirects: 5,
+		},
+		Health: HealthConfig{
+			CheckTimeout:  Duration(3 * time.Second),
+			MinFreeDiskMB: 512,
+		},
+		Trace: TraceConfig{
+			Exporter:    TRACE_EXPORTER_NONE,
+			ServiceName: "nft-proxy",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// configSetting binds a config value to its environment variable & flag
+type configSetting struct {
+	env   string
+	flag  string
+	usage string
+	value interface{} // *string, *int, *[]int, *bool, *float64, *Duration or *map[string]string
+}
+
+func (c *Config) settings() []configSetting {
+	return []configSetting{
+		{"HTTP_PORT", "http-port", "HTTP listen port", &c.HTTP.Port},
+		{"HTTP_READ_TIMEOUT", "http-read-timeout", "HTTP request read timeout", &c.HTTP.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", "http-write-timeout", "HTTP response write timeout", &c.HTTP.WriteTimeout},
+		{"HTTP_STREAM_TIMEOUT", "http-stream-timeout", "HTTP response write timeout for streamed media", &c.HTTP.StreamTimeout},
+		{"HTTP_IDLE_TIMEOUT", "http-idle-timeout", "HTTP keep-alive idle timeout", &c.HTTP.IdleTimeout},
+		{"HTTP_SHUTDOWN_TIMEOUT", "http-shutdown-timeout", "Time allowed for in-flight requests to drain on shutdown", &c.HTTP.ShutdownTimeout},
+		{"ADMIN_TOKEN", "admin-token", "Bearer token for /admin routes, admin routes are disabled when empty", &c.HTTP.AdminToken},
+		{"FAILED_IMAGE", "failed-image", "Image served when media cant be fetched", &c.HTTP.FailedImage},
+		{"PUBLIC_URL", "public-url", "Public base URL for image variant links", &c.HTTP.PublicURL},
+		{"RPC_URL", "rpc-url", "Solana RPC URL", &c.RPC.URL},
+		{"DB_DRIVER", "db-driver", "Storage driver, sqlite or postgres", &c.DB.Driver},
+		{"DB_DATABASE", "db-database", "SQLite database file", &c.DB.Database},
+		{"DB_DSN", "db-dsn", "Postgres DSN", &c.DB.DSN},
+		{"DB_MIGRATE", "db-migrate", "auto to apply migrations on start, manual to require the migrate command", &c.DB.Migrate},
+		{"CACHE_DIR", "cache-dir", "Resized image cache directory", &c.Cache.Dir},
+		{"CACHE_MAX_SIZE_MB", "cache-max-size-mb", "Image cache disk quota in MB, 0 for unlimited", &c.Cache.MaxSizeMB},
+		{"CACHE_EVICT_INTERVAL", "cache-evict-interval", "How often the image cache is checked against its quota", &c.Cache.EvictInterval},
+		{"CACHE_ACCESS_FLUSH_INTERVAL", "cache-access-flush-interval", "How often image cache access times are persisted", &c.Cache.AccessFlushInterval},
+		{"CACHE_MEMORY_MB", "cache-memory-mb", "Memory for the hottest resized images in MB, 0 to disable", &c.Cache.MemoryMB},
+		{"IMAGE_SIZE", "image-size", "Default resized image size in pixels", &c.Image.DefaultSize},
+		{"IMAGE_SIZES", "image-sizes", "Comma separated image variant sizes in pixels", &c.Image.Sizes},
+		{"JPEG_QUALITY", "jpeg-quality", "JPEG encoding quality (1-100)", &c.Image.JPEGQuality},
+		{"IMAGE_FETCH_TIMEOUT", "image-fetch-timeout", "Image & media download timeout", &c.Image.FetchTimeout},
+		{"METADATA_FETCH_TIMEOUT", "metadata-fetch-timeout", "Off-chain metadata download timeout", &c.Image.MetadataTimeout},
+		{"BLOCKED_IMAGE", "blocked-image", "Image served in place of blocked media", &c.Image.BlockedImage},
+		{"IMAGE_MAX_PIXELS", "image-max-pixels", "Largest source image decoded, in pixels", &c.Image.MaxPixels},
+		{"IMAGE_MAX_FRAMES", "image-max-frames", "Most frames decoded from an animated GIF", &c.Image.MaxFrames},
+		{"IMAGE_MAX_GIF_PIXELS", "image-max-gif-pixels", "Largest animated GIF decoded, in pixels across all frames", &c.Image.MaxGIFPixels},
+		{"LOG_LEVEL", "log-level", "Default log level, debug, info, warn or error", &c.Log.Level},
+		{"LOG_FORMAT", "log-format", "Log format, json or text", &c.Log.Format},
+		{"LOG_LEVELS", "log-levels", "Per subsystem log levels (e.g. http=debug,solana=warn)", &c.Log.Levels},
+		{"FETCH_MAX_BODY_MB", "fetch-max-body-mb", "Largest metadata or image download in MB", &c.Fetch.MaxBodyMB},
+		{"FETCH_MAX_MEDIA_MB", "fetch-max-media-mb", "Largest proxied media file in MB", &c.Fetch.MaxMediaMB},
+		{"FETCH_MAX_REDIRECTS", "fetch-max-redirects", "Redirects followed per download", &c.Fetch.MaxRedirects},
+		{"FETCH_ALLOW_PRIVATE", "fetch-allow-private", "Allow downloads from loopback & private addresses (development only)", &c.Fetch.AllowPrivate},
+		{"HEALTH_CHECK_TIMEOUT", "health-check-timeout", "Timeout for each readiness check", &c.Health.CheckTimeout},
+		{"HEALTH_MIN_FREE_DISK_MB", "health-min-free-disk-mb", "Free space in MB required on the cache volume to be ready", &c.Health.MinFreeDiskMB},
+		{"TRACE_EXPORTER", "trace-exporter", "Span exporter, none, otlp or stdout", &c.Trace.Exporter},
+		{"TRACE_ENDPOINT", "trace-endpoint", "OTLP/HTTP collector host:port", &c.Trace.Endpoint},
+		{"TRACE_INSECURE", "trace-insecure", "Export spans over plain HTTP", &c.Trace.Insecure},
+		{"TRACE_SERVICE_NAME", "trace-service-name", "Service name reported on spans", &c.Trace.ServiceName},
+		{"TRACE_SAMPLE_RATIO", "trace-sample-ratio", "Fraction of new traces sampled (0-1)", &c.Trace.SampleRatio},
+	}
+}
+
+func (s configSetting) set(v string) error {
+	switch p := s.value.(type) {
+	case *string:
+		*p = v
+	case *int:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s: invalid integer %q", s.env, v)
+		}
+		*p = i
+	case *bool:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", s.env, v)
+		}
+		*p = b
+	case *float64:
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("%s: invalid number %q", s.env, v)
+		}
+		*p = f
+	case *Duration:
+		if err := p.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("%s: invalid duration %q", s.env, v)
+		}
+	case *[]int:
+		var ints []int
+		for _, part := range strings.Split(v, ",") {
+			i, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return fmt.Errorf("%s: invalid integer %q", s.env, part)
+			}
+			ints = append(ints, i)
+		}
+		*p = ints
+	case *map[string]string:
+		m := map[string]string{}
+		for _, pair := range strings.Split(v, ",") {
+			k, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s: invalid pair %q, expected key=value", s.env, pair)
+			}
+			m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+		}
+		*p = m
+	}
+	return nil
+}
+
+// LoadConfig builds the config from defaults, the file given by -config or CONFIG_FILE, the environment & then the flags in args.
+// Pass nil args when the caller parses its own flags
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+	settings := cfg.settings()
+
+	fs := flag.NewFlagSet("nft-proxy", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML or TOML config file")
+	flags := map[string]*string{}
+	for _, s := range settings {
+		flags[s.flag] = fs.String(s.flag, "", s.usage+" ("+s.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		if err := cfg.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		if v, ok := os.LookupEnv(s.env); ok && v != "" {
+			if err := s.set(v); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = s.set(*flags[f.Name])
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		err = toml.NewDecoder(strings.NewReader(string(data))).DisallowUnknownFields().Decode(c)
+	default:
+		return fmt.Errorf("unsupported config file type: %s", path)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return nil
+}
+
+// placeholders are the images served in place of failed or blocked media, relative paths are from the working directory
+func (c *Config) placeholders() map[string]string {
+	return map[string]string{
+		"http.failed_image (FAILED_IMAGE)":    c.HTTP.FailedImage,
+		"image.blocked_image (BLOCKED_IMAGE)": c.Image.BlockedImage,
+	}
+}
+
+// Validate returns every problem with the config so they can be fixed in one go
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.HTTP.Port < 1 || c.HTTP.Port > 65535 {
+		fail("http.port (HTTP_PORT) must be between 1 and 65535, got %v", c.HTTP.Port)
+	}
+	for name, d := range map[string]Duration{
+		"http.read_timeout (HTTP_READ_TIMEOUT)":                     c.HTTP.ReadTimeout,
+		"http.write_timeout (HTTP_WRITE_TIMEOUT)":                   c.HTTP.WriteTimeout,
+		"http.stream_timeout (HTTP_STREAM_TIMEOUT)":                 c.HTTP.StreamTimeout,
+		"http.idle_timeout (HTTP_IDLE_TIMEOUT)":                     c.HTTP.IdleTimeout,
+		"http.shutdown_timeout (HTTP_SHUTDOWN_TIMEOUT)":             c.HTTP.ShutdownTimeout,
+		"image.fetch_timeout (IMAGE_FETCH_TIMEOUT)":                 c.Image.FetchTimeout,
+		"image.metadata_timeout (METADATA_FETCH_TIMEOUT)":           c.Image.MetadataTimeout,
+		"health.check_timeout (HEALTH_CHECK_TIMEOUT)":               c.Health.CheckTimeout,
+		"cache.evict_interval (CACHE_EVICT_INTERVAL)":               c.Cache.EvictInterval,
+		"cache.access_flush_interval (CACHE_ACCESS_FLUSH_INTERVAL)": c.Cache.AccessFlushInterval,
+	} {
+		if d <= 0 {
+			fail("%s must be positive", name)
+		}
+	}
+
+	if u, err := url.Parse(c.RPC.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		fail("rpc.url (RPC_URL) must be an http or https URL, got %q", c.RPC.URL)
+	}
+
+	switch c.DB.Driver {
+	case DB_DRIVER_SQLITE:
+		if c.DB.Database == "" {
+			fail("db.database (DB_DATABASE) is required for sqlite")
+		}
+	case DB_DRIVER_POSTGRES:
+		if c.DB.DSN == "" {
+			fail("db.dsn (DB_DSN) is required for postgres")
+		}
+	default:
+		fail("db.driver (DB_DRIVER) must be sqlite or postgres, got %q", c.DB.Driver)
+	}
+	if c.DB.Migrate != "auto" && c.DB.Migrate != "manual" {
+		fail("db.migrate (DB_MIGRATE) must be auto or manual, got %q", c.DB.Migrate)
+	}
+
+	if c.Cache.Dir == "" {
+		fail("cache.dir (CACHE_DIR) is required")
+	}
+	if c.Cache.MaxSizeMB < 0 {
+		fail("cache.max_size_mb (CACHE_MAX_SIZE_MB) cant be negative, got %v", c.Cache.MaxSizeMB)
+	}
+	if c.Cache.MemoryMB < 0 {
+		fail("cache.memory_mb (CACHE_MEMORY_MB) cant be negative, got %v", c.Cache.MemoryMB)
+	}
+	if c.Image.DefaultSize <= 0 {
+		fail("image.default_size (IMAGE_SIZE) must be positive, got %v", c.Image.DefaultSize)
+	}
+	for _, size := range c.Image.Sizes {
+		if size <= 0 {
+			fail("image.sizes (IMAGE_SIZES) must be positive, got %v", size)
+		}
+	}
+	if c.Image.JPEGQuality < 1 || c.Image.JPEGQuality > 100 {
+		fail("image.jpeg_quality (JPEG_QUALITY) must be between 1 and 100, got %v", c.Image.JPEGQuality)
+	}
+	for name, limit := range map[string]int{
+		"image.max_pixels (IMAGE_MAX_PIXELS)":         c.Image.MaxPixels,
+		"image.max_frames (IMAGE_MAX_FRAMES)":         c.Image.MaxFrames,
+		"image.max_gif_pixels (IMAGE_MAX_GIF_PIXELS)": c.Image.MaxGIFPixels,
+	} {
+		if limit <= 0 {
+			fail("%s must be positive, got %v", name, limit)
+		}
+	}
+
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		fail("log.level (LOG_LEVEL): %s", err)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		fail("log.format (LOG_FORMAT) must be json or text, got %q", c.Log.Format)
+	}
+	for name, l := range c.Log.Levels {
+		if !slices.Contains(logSubsystems, name) {
+			fail("log.levels (LOG_LEVELS): unknown subsystem %q, expected one of %s", name, strings.Join(logSubsystems, ", "))
+		} else if _, err := parseLogLevel(l); err != nil {
+			fail("log.levels (LOG_LEVELS): %s: %s", name, err)
+		}
+	}
+
+	if c.Fetch.MaxBodyMB <= 0 {
+		fail("fetch.max_body_mb (FETCH_MAX_BODY_MB) must be positive, got %v", c.Fetch.MaxBodyMB)
+	}
+	if c.Fetch.MaxMediaMB <= 0 {
+		fail("fetch.max_media_mb (FETCH_MAX_MEDIA_MB) must be positive, got %v", c.Fetch.MaxMediaMB)
+	}
+	if c.Fetch.MaxRedirects < 0 {
+		fail("fetch.max_redirects (FETCH_MAX_REDIRECTS) cant be negative, got %v", c.Fetch.MaxRedirects)
+	}
+	if c.Health.MinFreeDiskMB < 0 {
+		fail("health.min_free_disk_mb (HEALTH_MIN_FREE_DISK_MB) cant be negative, got %v", c.Health.MinFreeDiskMB)
+	}
+
+	switch c.Trace.Exporter {
+	case TRACE_EXPORTER_NONE, TRACE_EXPORTER_OTLP, TRACE_EXPORTER_STDOUT:
+	default:
+		fail("trace.exporter (TRACE_EXPORTER) must be none, otlp or stdout, got %q", c.Trace.Exporter)
+	}
+	if c.Trace.SampleRatio < 0 || c.Trace.SampleRatio > 1 {
+		fail("trace.sample_ratio (TRACE_SAMPLE_RATIO) must be between 0 and 1, got %v", c.Trace.SampleRatio)
+	}
+
+	return errors.Join(errs...)
+}
+
+// ConfigService provides the loaded Config to the other services, it must be registered first.
+// When Config is nil it is loaded from the config file & environment
+type ConfigService struct {
+	context.DefaultService
+	Config *Config
+}
+
+const CONFIG_SVC = "config_svc"
+
+func (svc *ConfigService) Id() string {
+	return CONFIG_SVC
+}
+
+func (svc *ConfigService) Configure(ctx *context.Context) error {
+	if svc.Config == nil {
+		cfg, err := LoadConfig(nil)
+		if err != nil {
+			return fmt.Errorf("invalid configuration:\n%w", err)
+		}
+		svc.Config = cfg
+	}
+
+	err := SetupLogging(svc.Config.Log, os.Stderr)
+	if err != nil {
+		return err
+	}
+
+	//Placeholders are only read by the services serving them, so a missing one doesnt stop the CLIs starting elsewhere
+	for name, path := range svc.Config.placeholders() {
+		if _, err := os.Stat(path); err != nil {
+			slog.Warn("Placeholder image not found, the services serving it wont start", "setting", name, "err", err)
+		}
+	}
+
+	return svc.DefaultService.Configure(ctx)
+}
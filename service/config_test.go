@@ -0,0 +1,80 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	img := filepath.Join(dir, "failed.jpg")
+	if err := os.WriteFile(img, []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(file, []byte(`
+http:
+  port: 9000
+  write_timeout: 90s
+  failed_image: `+img+`
+image:
+  jpeg_quality: 80
+  blocked_image: `+img+`
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("HTTP_PORT", "9100")
+	t.Setenv("JPEG_QUALITY", "70")
+	t.Setenv("IMAGE_SIZES", "128, 64")
+
+	cfg, err := LoadConfig([]string{"-jpeg-quality", "60"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.HTTP.Port != 9100 {
+		t.Errorf("expected env to override file port, got %v", cfg.HTTP.Port)
+	}
+	if cfg.HTTP.WriteTimeout.Duration() != 90*time.Second {
+		t.Errorf("expected file write timeout, got %s", cfg.HTTP.WriteTimeout)
+	}
+	if cfg.Image.JPEGQuality != 60 {
+		t.Errorf("expected flag to override env quality, got %v", cfg.Image.JPEGQuality)
+	}
+	if !slices.Equal(cfg.Image.Sizes, []int{128, 64}) {
+		t.Errorf("expected env sizes, got %v", cfg.Image.Sizes)
+	}
+	if cfg.Image.DefaultSize != DefaultImageSize {
+		t.Errorf("expected default size, got %v", cfg.Image.DefaultSize)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HTTP.Port = 0
+	cfg.DB.Driver = DB_DRIVER_POSTGRES
+	cfg.Image.JPEGQuality = 101
+	cfg.HTTP.FailedImage = "./missing.jpg"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{"HTTP_PORT", "DB_DSN", "JPEG_QUALITY"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error mentioning %s, got:\n%s", want, err)
+		}
+	}
+	//Only the services serving placeholders need them, so the CLIs & tests can start from any directory
+	if strings.Contains(err.Error(), "FAILED_IMAGE") {
+		t.Errorf("expected a missing placeholder not to fail validation, got:\n%s", err)
+	}
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"math"
+
+	"github.com/nfnt/resize"
+	"golang.org/x/image/draw"
+)
+
+// CropMode selects how an image is cropped to a square before it is resized
+type CropMode string
+
+const (
+	CropNone      CropMode = ""
+	CropCenter    CropMode = "center"
+	CropEntropy   CropMode = "entropy"   //Window with the most varied luminance
+	CropAttention CropMode = "attention" //Window with the most edges & saturated color
+)
+
+// CropModes are the modes that produce their own cached variants
+var CropModes = []CropMode{CropCenter, CropEntropy, CropAttention}
+
+var ErrInvalidCropMode = errors.New("invalid crop mode")
+
+const (
+	// cropSampleSize is the max dimension images are reduced to before scoring crop windows
+	cropSampleSize = 64
+	// entropyBins is the number of luminance buckets the entropy of a window is measured over
+	entropyBins = 32
+)
+
+// ParseCropMode validates a crop mode from a request, empty means no crop
+func ParseCropMode(s string) (CropMode, error) {
+	mode := CropMode(s)
+	if mode == CropNone {
+		return CropNone, nil
+	}
+	for _, m := range CropModes {
+		if m == mode {
+			return mode, nil
+		}
+	}
+	return CropNone, fmt.Errorf("%w: %q", ErrInvalidCropMode, s)
+}
+
+// cropRect returns the square region of the image kept by the crop mode, the full bounds when not cropping.
+// The window only moves along the longer axis so the whole of the shorter side is always kept
+func cropRect(img image.Image, mode CropMode) image.Rectangle {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if mode == CropNone || w == h || w == 0 || h == 0 {
+		return b
+	}
+
+	side, long := min(w, h), max(w, h)
+	horizontal := w > h
+	offset := (long - side) / 2
+
+	if mode == CropEntropy || mode == CropAttention {
+		small := resize.Thumbnail(cropSampleSize, cropSampleSize, img, resize.Bilinear)
+		sb := small.Bounds()
+		scale := float64(max(sb.Dx(), sb.Dy())) / float64(long)
+		window := max(1, int(math.Round(float64(side)*scale)))
+
+		lines := sampleLines(small, horizontal)
+		var best int
+		if mode == CropEntropy {
+			best = entropyWindow(lines, window)
+		} else {
+			best = attentionWindow(lines, window)
+		}
+		offset = min(int(math.Round(float64(best)/scale)), long-side)
+	}
+
+	if horizontal {
+		return image.Rect(b.Min.X+offset, b.Min.Y, b.Min.X+offset+side, b.Max.Y)
+	}
+	return image.Rect(b.Min.X, b.Min.Y+offset, b.Max.X, b.Min.Y+offset+side)
+}
+
+// cropSample is the luminance & saturation of a pixel, 0-255
+type cropSample struct {
+	luma, sat float64
+}
+
+// sampleLines returns the pixels of the image grouped into lines across the axis the crop window moves along,
+// columns for wide images & rows for tall ones
+func sampleLines(img image.Image, horizontal bool) [][]cropSample {
+	b := img.Bounds()
+	outer, inner := b.Dy(), b.Dx()
+	if horizontal {
+		outer, inner = inner, outer
+	}
+
+	lines := make([][]cropSample, outer)
+	for i := range lines {
+		lines[i] = make([]cropSample, inner)
+		for j := range lines[i] {
+			x, y := b.Min.X+j, b.Min.Y+i
+			if horizontal {
+				x, y = b.Min.X+i, b.Min.Y+j
+			}
+
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a == 0 {
+				continue //Transparent pixels carry no detail
+			}
+			rf, gf, bf := float64(r>>8), float64(g>>8), float64(bl>>8)
+			lines[i][j] = cropSample{
+				luma: 0.299*rf + 0.587*gf + 0.114*bf,
+				sat:  max(rf, gf, bf) - min(rf, gf, bf),
+			}
+		}
+	}
+	return lines
+}
+
+// entropyWindow returns the offset of the window of lines with the highest Shannon entropy of luminance
+func entropyWindow(lines [][]cropSample, window int) int {
+	window = min(window, len(lines))
+
+	var hist [entropyBins]int
+	add := func(line []cropSample, delta int) {
+		for _, s := range line {
+			hist[min(int(s.luma)*entropyBins/256, entropyBins-1)] += delta
+		}
+	}
+	entropy := func() float64 {
+		var total int
+		for _, n := range hist {
+			total += n
+		}
+		var e float64
+		for _, n := range hist {
+			if n > 0 {
+				p := float64(n) / float64(total)
+				e -= p * math.Log2(p)
+			}
+		}
+		return e
+	}
+
+	for _, line := range lines[:window] {
+		add(line, 1)
+	}
+	best, bestScore := 0, entropy()
+	for offset := 1; offset+window <= len(lines); offset++ {
+		add(lines[offset-1], -1)
+		add(lines[offset+window-1], 1)
+		if score := entropy(); score > bestScore {
+			best, bestScore = offset, score
+		}
+	}
+	return best
+}
+
+// attentionWindow returns the offset of the window of lines with the most salient pixels.
+// Saliency is approximated by edge strength plus color saturation, which favours subjects over flat backgrounds
+func attentionWindow(lines [][]cropSample, window int) int {
+	window = min(window, len(lines))
+
+	scores := make([]float64, len(lines))
+	for i, line := range lines {
+		for j, s := range line {
+			var edge float64
+			if j+1 < len(line) {
+				edge += math.Abs(s.luma - line[j+1].luma)
+			}
+			if i+1 < len(lines) {
+				edge += math.Abs(s.luma - lines[i+1][j].luma)
+			}
+			scores[i] += edge + s.sat/2
+		}
+	}
+
+	var sum float64
+	for _, s := range scores[:window] {
+		sum += s
+	}
+	best, bestScore := 0, sum
+	for offset := 1; offset+window <= len(lines); offset++ {
+		sum += scores[offset+window-1] - scores[offset-1]
+		if sum > bestScore {
+			best, bestScore = offset, sum
+		}
+	}
+	return best
+}
+
+// cropImage returns the region of the image, sharing pixels with the source where the image type allows
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	if rect == img.Bounds() {
+		return img
+	}
+	if sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
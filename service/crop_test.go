@@ -0,0 +1,97 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestParseCropMode(t *testing.T) {
+	for s, want := range map[string]CropMode{"": CropNone, "center": CropCenter, "entropy": CropEntropy, "attention": CropAttention} {
+		if mode, err := ParseCropMode(s); err != nil || mode != want {
+			t.Errorf("ParseCropMode(%q) = %q, %v", s, mode, err)
+		}
+	}
+	if _, err := ParseCropMode("top"); !errors.Is(err, ErrInvalidCropMode) {
+		t.Errorf("expected ErrInvalidCropMode, got %v", err)
+	}
+}
+
+func TestCropRect(t *testing.T) {
+	//Flat gray with a noisy, saturated patch at the right end of a wide image
+	wide := image.NewRGBA(image.Rect(0, 0, 120, 40))
+	rng := rand.New(rand.NewSource(1))
+	for x := 0; x < 120; x++ {
+		for y := 0; y < 40; y++ {
+			c := color.RGBA{R: 128, G: 128, B: 128, A: 255}
+			if x >= 90 {
+				c = color.RGBA{R: uint8(rng.Intn(256)), G: uint8(rng.Intn(64)), B: uint8(rng.Intn(256)), A: 255}
+			}
+			wide.Set(x, y, c)
+		}
+	}
+
+	for mode, want := range map[CropMode]image.Rectangle{
+		CropNone:      image.Rect(0, 0, 120, 40),
+		CropCenter:    image.Rect(40, 0, 80, 40),
+		CropEntropy:   image.Rect(80, 0, 120, 40),
+		CropAttention: image.Rect(80, 0, 120, 40),
+	} {
+		if got := cropRect(wide, mode); got != want {
+			t.Errorf("%s: expected %v, got %v", mode, want, got)
+		}
+	}
+
+	//Tall images move the window vertically
+	tall := image.NewRGBA(image.Rect(0, 0, 40, 100))
+	if got := cropRect(tall, CropCenter); got != image.Rect(0, 30, 40, 70) {
+		t.Errorf("expected vertical center crop, got %v", got)
+	}
+}
+
+func TestResizeVariantsCropGIF(t *testing.T) {
+	svc := ResizeService{}
+
+	var out bytes.Buffer
+	err := svc.ResizeVariants(context.Background(), testGIF(t, 3), map[int]io.Writer{20: &out}, ResizeOptions{Crop: CropAttention})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := gif.DecodeAll(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(img.Image) != 3 || img.Config.Width != 10 || img.Config.Height != 10 {
+		t.Fatalf("expected 3 square 10x10 frames, got %v frames of %vx%v", len(img.Image), img.Config.Width, img.Config.Height)
+	}
+	for i, frame := range img.Image {
+		if b := frame.Bounds(); b.Dx() != 10 || b.Dy() != 10 {
+			t.Errorf("frame %v: unexpected size %vx%v", i, b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestResizeVariantsCropTallSVG(t *testing.T) {
+	svc := ResizeService{maxPixels: 100_000}
+
+	var out bytes.Buffer
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 10 1000"><rect width="10" height="1000" fill="red"/></svg>`)
+	if err := svc.ResizeVariants(context.Background(), svg, map[int]io.Writer{100: &out}, ResizeOptions{Crop: CropCenter}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, _, err := image.DecodeConfig(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != 100 || cfg.Height != 100 {
+		t.Fatalf("expected 100x100, got %vx%v", cfg.Width, cfg.Height)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package services
+
+import "errors"
+
+// diskFree is only implemented on unix, the disk check fails elsewhere
+func diskFree(path string) (uint64, error) {
+	return 0, errors.New("free disk space is not supported on this platform")
+}
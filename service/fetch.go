@@ -0,0 +1,243 @@
+package services
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// FetchConfig limits requests to URLs taken from token metadata, which are untrusted
+type FetchConfig struct {
+	MaxBodyMB    int  `yaml:"max_body_mb" toml:"max_body_mb"`     // Metadata JSON & images
+	MaxMediaMB   int  `yaml:"max_media_mb" toml:"max_media_mb"`   // Proxied animation/video files
+	MaxRedirects int  `yaml:"max_redirects" toml:"max_redirects"` // Each hop is checked like the original URL
+	AllowPrivate bool `yaml:"allow_private" toml:"allow_private"` // Permit loopback & private addresses, for local development only
+}
+
+var (
+	ErrDisallowedScheme      = errors.New("url scheme not allowed")
+	ErrDisallowedAddress     = errors.New("destination address not allowed")
+	ErrTooManyRedirects      = errors.New("too many redirects")
+	ErrBodyTooLarge          = errors.New("response body too large")
+	ErrUnexpectedContentType = errors.New("unexpected content type")
+)
+
+// IsFetchViolation reports whether err was caused by a fetch policy rather than the remote being unavailable
+func IsFetchViolation(err error) bool {
+	return errors.Is(err, ErrDisallowedScheme) ||
+		errors.Is(err, ErrDisallowedAddress) ||
+		errors.Is(err, ErrTooManyRedirects) ||
+		errors.Is(err, ErrBodyTooLarge) ||
+		errors.Is(err, ErrUnexpectedContentType)
+}
+
+// contentKind is what the caller expects to download, each accepts a different set of content types
+type contentKind int
+
+const (
+	contentMetadata contentKind = iota
+	contentImage
+	contentMedia
+)
+
+func (k contentKind) accepts(contentType string) bool {
+	//Many gateways dont know what they are serving
+	if unknownContentType(contentType) {
+		return true
+	}
+	mediaType := parseMediaType(contentType)
+
+	switch k {
+	case contentMetadata:
+		return mediaType == "application/json" || mediaType == "text/json" || mediaType == "text/plain" ||
+			strings.HasSuffix(mediaType, "+json")
+	case contentImage:
+		return strings.HasPrefix(mediaType, "image/") || mediaType == "text/xml" || mediaType == "application/xml" ||
+			mediaType == "text/plain"
+	case contentMedia:
+		return strings.HasPrefix(mediaType, "video/") || strings.HasPrefix(mediaType, "audio/") ||
+			strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "model/")
+	}
+	return false
+}
+
+// unknownContentType reports whether the content type says nothing about what is served
+func unknownContentType(contentType string) bool {
+	switch parseMediaType(contentType) {
+	case "", "application/octet-stream", "binary/octet-stream":
+		return true
+	}
+	return false
+}
+
+// parseMediaType returns the lower case media type without parameters
+func parseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if contentType == "" || err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mediaType
+}
+
+// blockedPrefixes are ranges not covered by the net/netip helpers that still reach internal networks
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), //Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"), //NAT64 can embed any IPv4 address
+}
+
+// allowedAddress reports whether a resolved IP is publicly routable
+func allowedAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, p := range blockedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: %q", ErrDisallowedScheme, u.Scheme)
+	}
+	return nil
+}
+
+// SafeClient is an HTTP client for untrusted URLs, the destination is checked when each connection is dialed
+// so redirects & DNS answers that change between lookups cant reach internal addresses
+type SafeClient struct {
+	client *http.Client
+	cfg    FetchConfig
+}
+
+func NewSafeClient(cfg FetchConfig, timeout time.Duration) *SafeClient {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if cfg.AllowPrivate {
+				return nil
+			}
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrDisallowedAddress, address)
+			}
+			if !allowedAddress(addrPort.Addr()) {
+				return fmt.Errorf("%w: %s", ErrDisallowedAddress, addrPort.Addr())
+			}
+			return nil
+		},
+	}
+
+	return &SafeClient{
+		cfg: cfg,
+		client: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				Proxy:                 nil, //A proxy would be dialed instead of the destination, bypassing the address check
+				DialContext:           dialer.DialContext,
+				ForceAttemptHTTP2:     true,
+				MaxIdleConns:          100,
+				MaxIdleConnsPerHost:   10,
+				IdleConnTimeout:       90 * time.Second,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > cfg.MaxRedirects {
+					return fmt.Errorf("%w: %v", ErrTooManyRedirects, len(via))
+				}
+				return checkScheme(req.URL)
+			},
+		},
+	}
+}
+
+// Open requests uri & checks the response, the body is limited to the size allowed for kind & must be closed by the caller
+func (c *SafeClient) Open(ctx gocontext.Context, uri string, kind contentKind) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkScheme(req.URL); err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "PostmanRuntime/7.29.2")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := int64(c.cfg.MaxBodyMB) << 20
+	if kind == contentMedia {
+		limit = int64(c.cfg.MaxMediaMB) << 20
+	}
+
+	switch {
+	case resp.StatusCode != http.StatusOK:
+		err = errors.New(resp.Status)
+	case resp.ContentLength > limit:
+		err = fmt.Errorf("%w: %v bytes", ErrBodyTooLarge, resp.ContentLength)
+	case !kind.accepts(resp.Header.Get("Content-Type")):
+		err = fmt.Errorf("%w: %q", ErrUnexpectedContentType, resp.Header.Get("Content-Type"))
+	}
+	if err != nil {
+		resp.Body.Close()
+		return resp, err
+	}
+
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: limit}
+	return resp, nil
+}
+
+// Get downloads uri, see Open
+func (c *SafeClient) Get(ctx gocontext.Context, uri string, kind contentKind) ([]byte, *http.Response, error) {
+	resp, err := c.Open(ctx, uri, kind)
+	if err != nil {
+		return nil, resp, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	return data, resp, err
+}
+
+// limitedBody fails with ErrBodyTooLarge once more than remaining bytes are read,
+// servers can omit or understate Content-Length
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
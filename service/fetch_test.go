@@ -0,0 +1,117 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+)
+
+func TestAllowedAddress(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"8.8.8.8":         true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"::ffff:10.0.0.1": false,
+		"64:ff9b::a00:1":  false,
+	} {
+		if got := allowedAddress(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("allowedAddress(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func TestSafeClient(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("png"))
+	})
+	mux.HandleFunc("/html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		for i := 0; i < 3; i++ { //Chunked, so the size is only known while reading
+			_, _ = w.Write(bytes.Repeat([]byte{0}, 1<<20))
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := FetchConfig{MaxBodyMB: 1, MaxMediaMB: 1, MaxRedirects: 3}
+	ctx := context.Background()
+
+	_, _, err := NewSafeClient(cfg, time.Second).Get(ctx, srv.URL+"/image", contentImage)
+	if !errors.Is(err, ErrDisallowedAddress) {
+		t.Fatalf("expected loopback to be blocked, got %v", err)
+	}
+
+	cfg.AllowPrivate = true
+	client := NewSafeClient(cfg, time.Second)
+
+	data, _, err := client.Get(ctx, srv.URL+"/image", contentImage)
+	if err != nil || string(data) != "png" {
+		t.Fatalf("unexpected response %q: %v", data, err)
+	}
+
+	for path, want := range map[string]error{
+		"/html":  ErrUnexpectedContentType,
+		"/large": ErrBodyTooLarge,
+		"/loop":  ErrTooManyRedirects,
+		"/file":  ErrDisallowedScheme,
+	} {
+		_, _, err := client.Get(ctx, srv.URL+path, contentImage)
+		if !errors.Is(err, want) || !IsFetchViolation(err) {
+			t.Errorf("%s: expected %v, got %v", path, want, err)
+		}
+	}
+
+	if _, _, err := client.Get(ctx, "gopher://example.com/", contentImage); !errors.Is(err, ErrDisallowedScheme) {
+		t.Errorf("expected scheme to be rejected, got %v", err)
+	}
+}
+
+func TestStorageViolations(t *testing.T) {
+	for name, s := range testStorages(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, reason := range []string{"first", "second"} {
+				err := s.SaveViolation(&nft_proxy.MediaViolation{Mint: "violator", Stage: nft_proxy.ViolationStageFetch, Url: "http://10.0.0.1", Reason: reason})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			violations, err := s.Violations("violator", 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(violations) != 1 || violations[0].Reason != "second" || violations[0].Count != 2 {
+				t.Fatalf("unexpected violations: %+v", violations)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package services
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/babilu-online/common/context"
+	"github.com/gagliardetto/solana-go/rpc"
+	"github.com/gagliardetto/solana-go/rpc/jsonrpc"
+)
+
+// HealthConfig controls the readiness checks
+type HealthConfig struct {
+	CheckTimeout  Duration `yaml:"check_timeout" toml:"check_timeout"`       // Per check, a slow dependency counts as down
+	MinFreeDiskMB int      `yaml:"min_free_disk_mb" toml:"min_free_disk_mb"` // Free space required on the cache volume
+}
+
+// HealthService checks the dependencies needed to serve requests so orchestrators only route traffic to ready replicas
+type HealthService struct {
+	context.DefaultService
+
+	store *StorageService
+	sol   *SolanaService
+
+	cfg      HealthConfig
+	cacheDir string
+
+	mu      sync.Mutex //Held while checking so concurrent probes share one run
+	ready   bool
+	results map[string]*CheckResult
+	checked time.Time
+}
+
+const HEALTH_SVC = "health_svc"
+
+const (
+	CHECK_OK   = "ok"
+	CHECK_FAIL = "fail"
+)
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// readyCacheTTL is how long check results are reused, /readyz is unauthenticated & each run spends an RPC request
+const readyCacheTTL = 5 * time.Second
+
+// rpcMethodNotFound is returned by RPC providers that dont expose getHealth
+const rpcMethodNotFound = -32601
+
+func (svc *HealthService) Id() string {
+	return HEALTH_SVC
+}
+
+func (svc *HealthService) Start() error {
+	svc.store = svc.Service(STORAGE_SVC).(*StorageService)
+	svc.sol = svc.Service(SOLANA_SVC).(*SolanaService)
+
+	cfg := svc.Service(CONFIG_SVC).(*ConfigService).Config
+	svc.cfg = cfg.Health
+	svc.cacheDir = cfg.Cache.Dir
+	return nil
+}
+
+// Ready reports whether all checks passed, reusing results from the last readyCacheTTL
+func (svc *HealthService) Ready(ctx gocontext.Context) (bool, map[string]*CheckResult) {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if time.Since(svc.checked) >= readyCacheTTL {
+		//Results are shared, so a probe that disconnects cant fail them for the others
+		svc.ready, svc.results = svc.check(gocontext.WithoutCancel(ctx))
+		svc.checked = time.Now()
+	}
+	return svc.ready, svc.results
+}
+
+// check runs every check concurrently & reports whether all passed
+func (svc *HealthService) check(ctx gocontext.Context) (bool, map[string]*CheckResult) {
+	checks := map[string]func(ctx gocontext.Context) (string, error){
+		"database": svc.checkDatabase,
+		"rpc":      svc.checkRPC,
+		"cache":    svc.checkCacheWritable,
+		"disk":     svc.checkDiskFree,
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*CheckResult, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func(ctx gocontext.Context) (string, error)) {
+			defer wg.Done()
+			res := svc.run(ctx, check)
+
+			mu.Lock()
+			results[name] = res
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, res := range results {
+		ready = ready && res.Status == CHECK_OK
+	}
+	return ready, results
+}
+
+func (svc *HealthService) run(ctx gocontext.Context, check func(ctx gocontext.Context) (string, error)) *CheckResult {
+	ctx, cancel := gocontext.WithTimeout(ctx, svc.cfg.CheckTimeout.Duration())
+	defer cancel()
+
+	start := time.Now()
+	detail, err := check(ctx)
+	res := &CheckResult{Status: CHECK_OK, Detail: detail, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.Status = CHECK_FAIL
+		res.Error = err.Error()
+	}
+	return res
+}
+
+func (svc *HealthService) checkDatabase(ctx gocontext.Context) (string, error) {
+	return svc.store.Driver(), svc.store.Ping(ctx)
+}
+
+// checkRPC asks the node for its health, falling back to the current slot for providers without getHealth
+func (svc *HealthService) checkRPC(ctx gocontext.Context) (string, error) {
+	_, err := svc.sol.Client().GetHealth(ctx)
+	if err == nil {
+		return rpc.HealthOk, nil
+	}
+
+	var rpcErr *jsonrpc.RPCError
+	if !errors.As(err, &rpcErr) || rpcErr.Code != rpcMethodNotFound {
+		return "", err
+	}
+
+	slot, err := svc.sol.Client().GetSlot(ctx, rpc.CommitmentProcessed)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("slot %v", slot), nil
+}
+
+func (svc *HealthService) checkCacheWritable(ctx gocontext.Context) (string, error) {
+	f, err := os.CreateTemp(svc.cacheDir, ".readyz-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	_, err = f.Write([]byte("ok"))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if rerr := os.Remove(name); err == nil {
+		err = rerr
+	}
+	return svc.cacheDir, err
+}
+
+func (svc *HealthService) checkDiskFree(ctx gocontext.Context) (string, error) {
+	free, err := diskFree(svc.cacheDir)
+	if err != nil {
+		return "", err
+	}
+
+	freeMB := free / (1 << 20)
+	detail := fmt.Sprintf("%vMB free", freeMB)
+	if freeMB < uint64(svc.cfg.MinFreeDiskMB) {
+		return detail, fmt.Errorf("%vMB free, %vMB required", freeMB, svc.cfg.MinFreeDiskMB)
+	}
+	return detail, nil
+}
@@ -0,0 +1,46 @@
+package services
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealthChecks(t *testing.T) {
+	store := NewSqliteStorage("file:health_test?mode=memory&cache=shared")
+	if err := store.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	dir := t.TempDir()
+	svc := &HealthService{
+		store:    &StorageService{Storage: store, driver: DB_DRIVER_SQLITE},
+		cfg:      HealthConfig{CheckTimeout: Duration(time.Second)},
+		cacheDir: dir,
+	}
+
+	for name, check := range map[string]func(ctx context.Context) (string, error){
+		"database": svc.checkDatabase,
+		"cache":    svc.checkCacheWritable,
+		"disk":     svc.checkDiskFree,
+	} {
+		if res := svc.run(context.Background(), check); res.Status != CHECK_OK {
+			t.Errorf("%s: expected ok, got %+v", name, res)
+		}
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(dir, "*")); len(leftovers) != 0 {
+		t.Errorf("cache check left files behind: %v", leftovers)
+	}
+
+	svc.cfg.MinFreeDiskMB = 1 << 40
+	if res := svc.run(context.Background(), svc.checkDiskFree); res.Status != CHECK_FAIL {
+		t.Errorf("expected disk check to fail, got %+v", res)
+	}
+
+	svc.cacheDir = filepath.Join(dir, "missing")
+	if res := svc.run(context.Background(), svc.checkCacheWritable); res.Status != CHECK_FAIL {
+		t.Errorf("expected cache check to fail, got %+v", res)
+	}
+}
@@ -1,19 +1,33 @@
 package services
 
 import (
+	gocontext "context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
+	nft_proxy "github.com/alphabatem/nft-proxy"
 	"github.com/babilu-online/common/context"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // @title NFT Aggregator Swap API
@@ -30,48 +44,58 @@ type HttpService struct {
 	BaseURL string
 	Port    int
 
-	imgSvc  *ImageService
-	statSvc *StatService
+	imgSvc       *ImageService
+	solImgSvc    *SolanaImageService
+	statSvc      *StatService
+	healthSvc    *HealthService
+	blocklistSvc *BlocklistService
+
+	cfg    HTTPConfig
+	logger *slog.Logger
 
 	defaultImage []byte
+
+	server       *http.Server
+	shutdownOnce sync.Once
+	stopped      chan struct{} // Closed once in-flight requests have drained
 }
 
+const requestIDHeader = "X-Request-ID"
+
 var ErrUnauthorized = errors.New("unauthorized")
 var DeleteResponseOK = `{"status": 200, "error": ""}`
 
-func (svc HttpService) Id() string {
+func (svc *HttpService) Id() string {
 	return "http"
 }
 
-func (svc *HttpService) Configure(ctx *context.Context) error {
-	port := os.Getenv("HTTP_PORT")
-	portFlag, err := strconv.Atoi(port)
-	if err != nil {
-		return err
-	}
-
-	svc.Port = portFlag
+func (svc *HttpService) Start() error {
+	svc.cfg = svc.Service(CONFIG_SVC).(*ConfigService).Config.HTTP
+	svc.logger = Logger(LOG_HTTP)
+	svc.Port = svc.cfg.Port
+	svc.BaseURL = strings.TrimSuffix(svc.cfg.PublicURL, "/")
 
-	svc.defaultImage, err = ioutil.ReadFile("./docs/failed_image.jpg")
+	var err error
+	svc.defaultImage, err = ioutil.ReadFile(svc.cfg.FailedImage)
 	if err != nil {
-		return err
+		return fmt.Errorf("http.failed_image (FAILED_IMAGE): %w", err)
 	}
 
-	return svc.DefaultService.Configure(ctx)
-}
-
-func (svc *HttpService) Start() error {
 	svc.imgSvc = svc.Service(IMG_SVC).(*ImageService)
+	svc.solImgSvc = svc.Service(SOLANA_IMG_SVC).(*SolanaImageService)
 	svc.statSvc = svc.Service(STAT_SVC).(*StatService)
+	svc.healthSvc = svc.Service(HEALTH_SVC).(*HealthService)
+	svc.blocklistSvc = svc.Service(BLOCKLIST_SVC).(*BlocklistService)
 
-	r := gin.Default()
+	r := gin.New()
 
-	r.Use(gin.Recovery())
+	r.Use(svc.requestID, svc.traceRequest, svc.accessLog, gin.Recovery())
 
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
 	config.AllowCredentials = true
-	config.AddAllowHeaders("Authorization")
+	config.AddAllowHeaders("Authorization", requestIDHeader)
+	config.AddExposeHeaders(requestIDHeader)
 	r.Use(cors.New(config))
 
 	//r.Static("static", "static")
@@ -80,6 +104,8 @@ func (svc *HttpService) Start() error {
 	//Validation endpoints
 	r.GET("/ping", svc.ping)
 	r.GET("/stats", svc.stats)
+	r.GET("/healthz", svc.healthz)
+	r.GET("/readyz", svc.readyz)
 
 	v1 := r.Group("/v1")
 	//docs.SwaggerInfo.BasePath = "/v1"
@@ -88,18 +114,93 @@ func (svc *HttpService) Start() error {
 	svc.registerNFTEndpoints(v1, "tokens")
 	svc.registerNFTEndpoints(v1, "nfts")
 
+	admin := r.Group("/admin", svc.adminAuth)
+	admin.GET("/blocklist", svc.listBlocklist)
+	admin.POST("/blocklist", svc.addBlocklist)
+	admin.DELETE("/blocklist/:kind/:key", svc.removeBlocklist)
+	admin.GET("/violations", svc.listViolations)
+
 	r.NoRoute(func(c *gin.Context) {
 		c.JSON(404, gin.H{"code": "PAGE_NOT_FOUND", "message": "Page not found"})
 	})
 
-	return r.Run(fmt.Sprintf(":%v", svc.Port))
+	svc.server = &http.Server{
+		Addr:              fmt.Sprintf(":%v", svc.Port),
+		Handler:           withResponseController(r),
+		ReadHeaderTimeout: svc.cfg.ReadTimeout.Duration(),
+		ReadTimeout:       svc.cfg.ReadTimeout.Duration(),
+		WriteTimeout:      svc.cfg.WriteTimeout.Duration(),
+		IdleTimeout:       svc.cfg.IdleTimeout.Duration(),
+	}
+	svc.stopped = make(chan struct{})
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		defer signal.Stop(sig)
+		select {
+		case s := <-sig:
+			svc.logger.Info("Draining in-flight requests", "signal", s.String())
+			svc.Shutdown()
+		case <-svc.stopped:
+		}
+	}()
+
+	err = svc.server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-svc.stopped
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections & waits up to the configured shutdown timeout for in-flight requests to finish
+func (svc *HttpService) Shutdown() {
+	svc.shutdownOnce.Do(func() {
+		if svc.server == nil {
+			return
+		}
+
+		ctx, cancel := gocontext.WithTimeout(gocontext.Background(), svc.cfg.ShutdownTimeout.Duration())
+		defer cancel()
+
+		if err := svc.server.Shutdown(ctx); err != nil {
+			svc.logger.Error("HTTP shutdown failed", "err", err)
+		}
+		close(svc.stopped)
+	})
 }
 
 func (svc *HttpService) registerNFTEndpoints(g *gin.RouterGroup, prefix string) {
 	r := g.Group(prefix)
 	r.GET("/:id", svc.showNFT)
 	r.GET("/:id/image", svc.showNFTImage) // So much repetition but same service
-	r.GET("/:id/media", svc.showNFTMedia)
+	for _, format := range OutputFormats {
+		r.GET("/:id/image."+format, svc.showNFTImage) //Embeds (Discord, Open Graph) expect an extension matching the content
+	}
+	r.GET("/:id/media", svc.streamDeadline, svc.showNFTMedia)
+	r.GET("/:id/palette", svc.showNFTPalette)
+	r.GET("/:id/similar", svc.showSimilarNFTs)
+}
+
+type responseControllerKey struct{}
+
+// withResponseController keeps the connections ResponseController on the request, gins writer doesnt expose it
+func withResponseController(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := gocontext.WithValue(r.Context(), responseControllerKey{}, http.NewResponseController(w))
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// streamDeadline replaces the server write timeout with the stream timeout, so large media isnt cut off mid body
+func (svc *HttpService) streamDeadline(c *gin.Context) {
+	if rc, ok := c.Request.Context().Value(responseControllerKey{}).(*http.ResponseController); ok {
+		if err := rc.SetWriteDeadline(time.Now().Add(svc.cfg.StreamTimeout.Duration())); err != nil {
+			svc.logger.Warn("Failed to extend write deadline", "err", err)
+		}
+	}
+	c.Next()
 }
 
 type Pong struct {
@@ -116,6 +217,25 @@ func (svc *HttpService) ping(c *gin.Context) {
 	})
 }
 
+// @Summary Liveness probe, the process is up & serving
+// @Produce json
+// @Router /healthz [get]
+func (svc *HttpService) healthz(c *gin.Context) {
+	c.JSON(200, gin.H{"status": "ok"})
+}
+
+// @Summary Readiness probe, checks the database, RPC & cache volume. Results are reused for 5s
+// @Produce json
+// @Router /readyz [get]
+func (svc *HttpService) readyz(c *gin.Context) {
+	ready, checks := svc.healthSvc.Ready(c.Request.Context())
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(200, gin.H{"status": "ready", "checks": checks})
+}
+
 // @Summary Ping liquify service
 // @Accept  json
 // @Produce json
@@ -141,39 +261,85 @@ func (svc *HttpService) showNFT(c *gin.Context) {
 
 	skipCache, _ := strconv.ParseBool(c.DefaultQuery("nocache", ""))
 	if skipCache || rand.Intn(1000) == 1 {
-		if err := svc.imgSvc.ClearCache(c.Param("id")); err != nil {
+		if err := svc.imgSvc.ClearCache(c.Request.Context(), c.Param("id")); err != nil {
 			svc.paramErr(c, err)
 			return
 		}
 	}
 
-	media, err := svc.imgSvc.Media(c.Param("id"), skipCache)
+	media, err := svc.imgSvc.Media(c.Request.Context(), c.Param("id"), skipCache)
 	if err != nil {
 		svc.paramErr(c, err)
 		return
 	}
 
+	media.Variants = svc.imageVariants(c.Request.URL.Path, media)
+
 	c.Header("Cache-Control", "public, max-age=172800")
 	c.Header("Expires", time.Now().AddDate(0, 0, 2).Format(http.TimeFormat))
 
 	c.JSON(200, media)
 }
 
+// imageVariants links every resized size of the image served under the metadata path, e.g /v1/nfts/{id}
+func (svc *HttpService) imageVariants(metadataPath string, media *nft_proxy.Media) []nft_proxy.ImageVariant {
+	sizes := svc.imgSvc.Sizes()
+	variants := make([]nft_proxy.ImageVariant, 0, len(sizes))
+	for _, size := range sizes {
+		variants = append(variants, nft_proxy.ImageVariant{
+			Size: svc.imgSvc.VariantHeight(media, size),
+			Url:  fmt.Sprintf("%s%s/image?size=%d", svc.BaseURL, metadataPath, size),
+		})
+	}
+	return variants
+}
+
 // @Summary Get NFT image
 // @Description Get NFT image by ID
 // @Accept  json
 // @Produce image/*
 // @Param   id  path  string  true  "NFT ID"
+// @Param   size  query  int  false  "Image height, snapped to the nearest configured variant"
+// @Param   crop  query  string  false  "Crop to a square: center, entropy or attention"
+// @Param   format  query  string  false  "Encode as jpg, png, webp or gif, also selected by the image.{format} routes"
 // @Router /v1/nfts/{id}/image [get]
+// @Router /v1/nfts/{id}/image.jpg [get]
+// @Router /v1/nfts/{id}/image.png [get]
+// @Router /v1/nfts/{id}/image.webp [get]
+// @Router /v1/nfts/{id}/image.gif [get]
 func (svc *HttpService) showNFTImage(c *gin.Context) {
 	svc.statSvc.IncrementImageFileRequests()
-	err := svc.imgSvc.ImageFile(c, c.Param("id"))
+	format, err := imageFormat(c.Query("format"), strings.TrimPrefix(path.Ext(c.FullPath()), "."))
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+	err = svc.imgSvc.ImageFile(c, c.Param("id"), format)
+	if errors.Is(err, ErrInvalidImageFormat) || errors.Is(err, ErrInvalidCropMode) {
+		svc.paramErr(c, err)
+		return
+	}
 	if err != nil {
 		svc.mediaError(c, err)
 		return
 	}
 }
 
+// imageFormat returns the requested image format, the extension of an image.{format} route cant be contradicted by ?format=
+func imageFormat(query string, ext string) (string, error) {
+	format, err := ParseOutputFormat(query)
+	if err != nil {
+		return "", err
+	}
+	if ext == "" {
+		return format, nil
+	}
+	if format != "" && format != ext {
+		return "", fmt.Errorf("%w: format %q conflicts with .%s", ErrInvalidImageFormat, query, ext)
+	}
+	return ext, nil
+}
+
 // @Summary Get NFT media
 // @Description Get NFT media file by ID
 // @Accept  json
@@ -189,6 +355,204 @@ func (svc *HttpService) showNFTMedia(c *gin.Context) {
 	}
 }
 
+// @Summary Get NFT color palette
+// @Description Get the dominant color & palette of the NFT image by ID
+// @Accept  json
+// @Produce json
+// @Param   id  path  string  true  "NFT ID"
+// @Router /v1/nfts/{id}/palette [get]
+func (svc *HttpService) showNFTPalette(c *gin.Context) {
+	svc.statSvc.IncrementMediaRequests()
+
+	media, err := svc.imgSvc.Palette(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "public, max-age=172800")
+	c.Header("Expires", time.Now().AddDate(0, 0, 2).Format(http.TimeFormat))
+
+	c.JSON(200, gin.H{
+		"mint":          media.Mint,
+		"dominantColor": media.DominantColor,
+		"palette":       media.Palette,
+	})
+}
+
+// @Summary Get similar NFTs
+// @Description Get mints whose image perceptual hash is within a Hamming distance of the NFT image, each with its blur hash placeholder
+// @Accept  json
+// @Produce json
+// @Param   id  path  string  true  "NFT ID"
+// @Param   distance  query  int  false  "Max Hamming distance (0-7, default 5)"
+// @Router /v1/nfts/{id}/similar [get]
+func (svc *HttpService) showSimilarNFTs(c *gin.Context) {
+	svc.statSvc.IncrementMediaRequests()
+
+	distance, err := strconv.Atoi(c.DefaultQuery("distance", strconv.Itoa(DefaultSimilarDistance)))
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	media, similar, err := svc.imgSvc.Similar(c.Request.Context(), c.Param("id"), distance)
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"mint":            media.Mint,
+		"updateAuthority": media.UpdateAuthority,
+		"blurHash":        media.BlurHash,
+		"pHash":           media.PHash,
+		"similar":         similar,
+	})
+}
+
+// @Summary List recently refused media
+// @Accept  json
+// @Produce json
+// @Param   mint  query  string  false  "Only violations for the mint"
+// @Param   limit  query  int  false  "Max entries, 1 to 1000"
+// @Router /admin/violations [get]
+func (svc *HttpService) listViolations(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit < 1 || limit > 1000 {
+		svc.paramErr(c, errors.New("limit must be between 1 and 1000"))
+		return
+	}
+
+	violations, err := svc.solImgSvc.Violations(c.Query("mint"), limit)
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	c.JSON(200, violations)
+}
+
+// @Summary List blocklist entries
+// @Accept  json
+// @Produce json
+// @Router /admin/blocklist [get]
+func (svc *HttpService) listBlocklist(c *gin.Context) {
+	entries, err := svc.blocklistSvc.List()
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	c.JSON(200, entries)
+}
+
+// @Summary Block a mint, collection or update authority
+// @Accept  json
+// @Produce json
+// @Param   entry  body  nft_proxy.BlockedMedia  true  "Blocklist entry"
+// @Router /admin/blocklist [post]
+func (svc *HttpService) addBlocklist(c *gin.Context) {
+	var entry nft_proxy.BlockedMedia
+	if err := c.ShouldBindJSON(&entry); err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	if err := svc.blocklistSvc.Add(&entry); err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	c.JSON(200, entry)
+}
+
+// @Summary Unblock a mint, collection or update authority
+// @Accept  json
+// @Produce json
+// @Param   kind  path  string  true  "mint, collection or update_authority"
+// @Param   key   path  string  true  "Blocked key"
+// @Router /admin/blocklist/{kind}/{key} [delete]
+func (svc *HttpService) removeBlocklist(c *gin.Context) {
+	err := svc.blocklistSvc.Remove(nft_proxy.BlockKind(c.Param("kind")), c.Param("key"))
+	if err != nil {
+		svc.paramErr(c, err)
+		return
+	}
+
+	c.Data(200, "application/json", []byte(DeleteResponseOK))
+}
+
+// adminAuth requires ADMIN_TOKEN as a bearer token, admin routes are disabled when no token is configured
+func (svc *HttpService) adminAuth(c *gin.Context) {
+	token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if svc.cfg.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(svc.cfg.AdminToken)) != 1 {
+		svc.paramErr(c, ErrUnauthorized)
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// requestID tags the request with the caller's X-Request-ID or a new one, its added to every log line written with the request context
+func (svc *HttpService) requestID(c *gin.Context) {
+	id := c.GetHeader(requestIDHeader)
+	if !validRequestID(id) {
+		id = NewRequestID()
+	}
+
+	c.Header(requestIDHeader, id)
+	c.Request = c.Request.WithContext(WithRequestID(c.Request.Context(), id))
+	c.Next()
+}
+
+// traceRequest starts the server span for the request, continuing the caller's trace when traceparent is sent
+func (svc *HttpService) traceRequest(c *gin.Context) {
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Request.Method),
+			semconv.HTTPRoute(route),
+			attribute.String("request_id", RequestID(ctx)),
+		),
+	)
+	defer span.End()
+
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+func (svc *HttpService) accessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	level := slog.LevelInfo
+	if c.FullPath() == "/healthz" || c.FullPath() == "/readyz" {
+		level = slog.LevelDebug //Probes would drown out real traffic
+	}
+	svc.logger.Log(c.Request.Context(), level, "Request",
+		"method", c.Request.Method,
+		"path", c.Request.URL.Path,
+		"status", c.Writer.Status(),
+		"bytes", c.Writer.Size(),
+		"duration_ms", time.Since(start).Milliseconds(),
+		"client_ip", c.ClientIP(),
+	)
+}
+
 // Consistent error handling with proper status codes
 func (svc *HttpService) paramErr(c *gin.Context, err error) {
 	status := http.StatusBadRequest
@@ -202,7 +566,10 @@ func (svc *HttpService) paramErr(c *gin.Context, err error) {
 
 // TODO Replace with placeholder image
 func (svc *HttpService) mediaError(c *gin.Context, err error) {
-	log.Printf("Media Error: %v", err)
+	svc.logger.WarnContext(c.Request.Context(), "Media error", "path", c.Request.URL.Path, "err", err)
+	if c.Writer.Written() {
+		return //Failed mid body, the placeholder cant be appended
+	}
 	c.Header("Cache-Control", "public, max-age=60, must-revalidate")
 	c.Data(http.StatusOK, "image/jpeg", svc.defaultImage)
 }
@@ -1,12 +1,19 @@
 package services
 
 import (
+	"bytes"
+	gocontext "context"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -14,25 +21,33 @@ import (
 	"github.com/babilu-online/common/context"
 	"github.com/gagliardetto/solana-go"
 	"github.com/gin-gonic/gin"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ImageService struct {
 	context.DefaultService
 
 	defaultSize int
+	sizes       []int //Variants generated from each download, smallest first
+	cacheDir    string
 
-	httpMedia *http.Client
+	httpMedia  *SafeClient
+	httpStream *SafeClient //Proxied media, bounded by the stream timeout rather than the fetch timeout
+	logger     *slog.Logger
 
-	solSvc *SolanaImageService
-	resize *ResizeService
-	sql    *SqliteService
+	solSvc    *SolanaImageService
+	resize    *ResizeService
+	cache     *CacheService
+	store     *StorageService
+	blocklist *BlocklistService
 
 	exemptImages map[string]struct{} //Some older & core tokens dont have active metadata so we shouldn't update them
 }
 
 const IMG_SVC = "img_svc"
 
-const DefaultImageSize = 720 // ✅ Define a constant
+const DefaultImageSize = 720
 
 func (svc ImageService) Id() string {
 	return IMG_SVC
@@ -40,12 +55,22 @@ func (svc ImageService) Id() string {
 
 func (svc *ImageService) Start() error {
 	svc.solSvc = svc.Service(SOLANA_IMG_SVC).(*SolanaImageService)
-	svc.sql = svc.Service(SQLITE_SVC).(*SqliteService)
+	svc.store = svc.Service(STORAGE_SVC).(*StorageService)
 	svc.resize = svc.Service(RESIZE_SVC).(*ResizeService)
+	svc.cache = svc.Service(CACHE_SVC).(*CacheService)
+	svc.blocklist = svc.Service(BLOCKLIST_SVC).(*BlocklistService)
 
-	svc.httpMedia = &http.Client{Timeout: 10 * time.Second}
+	cfg := svc.Service(CONFIG_SVC).(*ConfigService).Config
+	svc.httpMedia = NewSafeClient(cfg.Fetch, cfg.Image.FetchTimeout.Duration())
+	svc.httpStream = NewSafeClient(cfg.Fetch, cfg.HTTP.StreamTimeout.Duration())
+	svc.logger = Logger(LOG_IMAGE)
 
-	svc.defaultSize = DefaultImageSize //Gifs will be half the size
+	svc.defaultSize = cfg.Image.DefaultSize //Gifs will be half the size
+	svc.sizes = variantSizes(cfg.Image.Sizes, svc.defaultSize)
+	svc.cacheDir = cfg.Cache.Dir
+	if err := os.MkdirAll(svc.cacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache dir: %w", err)
+	}
 
 	svc.exemptImages = map[string]struct{}{
 		"2kMpEJCZL8vEDZe7YPLMCS9Y3WKSAMedXBn7xHPvsWvi": {},
@@ -61,21 +86,36 @@ func (svc *ImageService) Start() error {
 	return nil
 }
 
-func (svc *ImageService) Media(key string, skipCache bool) (*nft_proxy.Media, error) {
+func (svc *ImageService) Media(ctx gocontext.Context, key string, skipCache bool) (*nft_proxy.Media, error) {
 	if svc.IsSolKey(key) {
-		return svc.solSvc.Media(key, skipCache)
+		media, err := svc.solSvc.Media(ctx, key, skipCache)
+		if err != nil {
+			return nil, err
+		}
+		media.Blocked = svc.blocklist.IsBlocked(media)
+		return media, nil
 	}
 
 	return nil, errors.New("invalid key")
 }
 
-func (svc *ImageService) ImageFile(c *gin.Context, key string) error {
+// ImageFile writes the resized image, format selects the encoder & is empty to keep the format chosen from the source
+func (svc *ImageService) ImageFile(c *gin.Context, key string, format string) error {
+	//Hot images are served from memory without hitting the DB
+	if img, ok := svc.hotImage(c, key, format); ok {
+		if svc.blocklist.IsBlocked(img.Owner) {
+			return svc.writeBlocked(c)
+		}
+		svc.cache.Touch(img.Path)
+		return svc.writeCached(c, img)
+	}
+
 	var err error
 
 	//Fetch the image file to see if its already in the system
 	var media *nft_proxy.Media
 	if svc.IsSolKey(key) {
-		media, err = svc.solSvc.Media(key, false)
+		media, err = svc.solSvc.Media(c.Request.Context(), key, false)
 		if err != nil {
 			return err
 		}
@@ -83,23 +123,297 @@ func (svc *ImageService) ImageFile(c *gin.Context, key string) error {
 		return errors.New("unsupported chain")
 	}
 
-	cacheName := fmt.Sprintf("./cache/solana/%s.%s", media.Mint, media.ImageType)
+	if svc.blocklist.IsBlocked(media) {
+		return svc.writeBlocked(c)
+	}
+
+	if media.ImageType == "svg" && format == "" { //A requested format is always rasterized
+		if vector, _ := strconv.ParseBool(c.Query("vector")); vector {
+			return svc.vectorFile(c, media)
+		}
+	}
+
+	if media.ImageType == "gif" || media.Animated {
+		static, _ := strconv.ParseBool(c.Query("static"))
+		frame, err := strconv.Atoi(c.DefaultQuery("frame", "-1"))
+		if err != nil {
+			frame = -1
+		}
+		if static || frame >= 0 || c.Query("variant") == "poster" {
+			format, err := ParseOutputFormat(format)
+			if err != nil {
+				return err
+			}
+			return svc.staticFile(c, media, max(frame, 0), format)
+		}
+	}
+
+	opts, err := svc.resizeOptions(c, format)
+	if err != nil {
+		return err
+	}
+	size := svc.variantSize(c.Query("size"))
+	cacheName := svc.variantPath(media, size, opts)
+
+	//Held from before the stat so the evictor cant remove the file between finding & serving it
+	release := svc.cache.Acquire(cacheName)
+	defer release()
 
 	//Check for file or fetch
 	ifo, err := os.Stat(cacheName)
 	if err != nil || ifo.Size() == 0 { //Missing cached image
-		err := svc.fetchMissingImage(media, cacheName)
+		if opts == (ResizeOptions{}) {
+			err = svc.fetchMissingImage(c.Request.Context(), media)
+		} else {
+			err = svc.fetchMissingVariant(c.Request.Context(), media, opts)
+		}
 		if err != nil {
 			return err
 		}
+		if sniffed := svc.variantPath(media, size, opts); sniffed != cacheName { //Type may have changed after sniffing
+			cacheName = sniffed
+			release := svc.cache.Acquire(cacheName)
+			defer release()
+		}
 	}
 	//log.Printf("Using cached file: %s", cacheName)
 
-	return svc.writeFile(c, cacheName, media)
+	return svc.writeHot(c, media, svc.hotKey(media.Mint, size, opts), cacheName, imageContentType(svc.variantType(media, opts)))
+}
+
+// resizeOptions parses the crop from the request & the requested output format
+func (svc *ImageService) resizeOptions(c *gin.Context, format string) (ResizeOptions, error) {
+	crop, err := ParseCropMode(c.Query("crop"))
+	if err != nil {
+		return ResizeOptions{}, err
+	}
+	format, err = ParseOutputFormat(format)
+	if err != nil {
+		return ResizeOptions{}, err
+	}
+	return ResizeOptions{Crop: crop, Format: format}, nil
+}
+
+// hotImage returns the in memory copy of the requested resized image, vectors & frames are always read from disk
+func (svc *ImageService) hotImage(c *gin.Context, key string, format string) (*CachedImage, bool) {
+	for _, q := range []string{"vector", "static", "frame", "variant"} {
+		if c.Query(q) != "" {
+			return nil, false
+		}
+	}
+	opts, err := svc.resizeOptions(c, format)
+	if err != nil {
+		return nil, false
+	}
+	return svc.cache.HotImage(svc.hotKey(key, svc.variantSize(c.Query("size")), opts))
+}
+
+// hotKey identifies a resized image in the memory cache
+func (svc *ImageService) hotKey(mint string, size int, opts ResizeOptions) string {
+	if opts == (ResizeOptions{}) && size == svc.defaultSize {
+		return mint
+	}
+	key := fmt.Sprintf("%s.%d", mint, size)
+	if opts.Crop != CropNone {
+		key += "." + string(opts.Crop)
+	}
+	if opts.Format != "" {
+		key += ":" + opts.Format //Cant clash with a crop mode
+	}
+	return key
+}
+
+// Sizes returns the image variant sizes, smallest first
+func (svc *ImageService) Sizes() []int {
+	return svc.sizes
+}
+
+// VariantHeight returns the height the variant of size is served at, animated GIFs are encoded at half size
+func (svc *ImageService) VariantHeight(media *nft_proxy.Media, size int) int {
+	if svc.cacheType(media) == "gif" {
+		return gifHeight(size)
+	}
+	return size
+}
+
+// variantSize returns the smallest variant at least as large as the requested size, or the largest variant.
+// The default size is used when no valid size is requested
+func (svc *ImageService) variantSize(requested string) int {
+	n, err := strconv.Atoi(requested)
+	if err != nil || n <= 0 {
+		return svc.defaultSize
+	}
+	for _, size := range svc.sizes {
+		if size >= n {
+			return size
+		}
+	}
+	return svc.sizes[len(svc.sizes)-1]
+}
+
+// variantSizes returns the configured sizes sorted & deduplicated, always including the default size
+func variantSizes(configured []int, defaultSize int) []int {
+	sizes := append([]int{defaultSize}, configured...)
+	slices.Sort(sizes)
+	return slices.Compact(sizes)
+}
+
+// CacheImage downloads & resizes the image for the media if it isnt already cached
+func (svc *ImageService) CacheImage(ctx gocontext.Context, media *nft_proxy.Media) error {
+	ifo, err := os.Stat(svc.cachePath(media))
+	if err == nil && ifo.Size() > 0 {
+		return nil
+	}
+
+	return svc.fetchMissingImage(ctx, media)
+}
+
+// Palette returns the media with its color palette, extracting it from the cached image if it hasnt been yet
+func (svc *ImageService) Palette(ctx gocontext.Context, key string) (*nft_proxy.Media, error) {
+	media, err := svc.Media(ctx, key, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if media.DominantColor == "" {
+		err = svc.ensureAnalyzed(ctx, media)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return media, nil
+}
+
+// Similar returns the media along with other mints whose image is within maxDistance bits of its perceptual hash
+func (svc *ImageService) Similar(ctx gocontext.Context, key string, maxDistance int) (*nft_proxy.Media, []*nft_proxy.SimilarMedia, error) {
+	if maxDistance < 0 || maxDistance > MaxSimilarDistance {
+		return nil, nil, fmt.Errorf("distance must be between 0 and %v", MaxSimilarDistance)
+	}
+
+	media, err := svc.Media(ctx, key, false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if media.PHash == "" {
+		err = svc.ensureAnalyzed(ctx, media)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	hash, err := strconv.ParseUint(media.PHash, 16, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid perceptual hash: %w", err)
+	}
+
+	similar, err := svc.solSvc.SimilarMedia(media.Mint, hash, maxDistance)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return media, similar, nil
 }
 
-func (svc *ImageService) ClearCache(key string) error {
-	m, err := svc.solSvc.Media(key, false)
+// vectorFile serves the sanitized source SVG for clients that accept image/svg+xml
+func (svc *ImageService) vectorFile(c *gin.Context, media *nft_proxy.Media) error {
+	cacheName := svc.cacheFile(fmt.Sprintf("%s.svg", media.Mint))
+	release := svc.cache.Acquire(cacheName)
+	defer release()
+
+	ifo, err := os.Stat(cacheName)
+	if err != nil || ifo.Size() == 0 {
+		err := svc.fetchMissingVector(c.Request.Context(), media, cacheName)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.Header("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+	return svc.writeFile(c, cacheName, "image/svg+xml")
+}
+
+// staticFile serves a single composited frame of an animated source as a poster, JPEG unless another format is requested.
+// Frames past the end are clamped to the last so each source has a bounded number of cached posters
+func (svc *ImageService) staticFile(c *gin.Context, media *nft_proxy.Media, frame int, format string) error {
+	if format == "" {
+		format = "jpg"
+	}
+	if frame > 0 {
+		frames, err := svc.frameCount(c.Request.Context(), media)
+		if err != nil {
+			return err
+		}
+		frame = min(frame, max(frames-1, 0))
+	}
+	cacheName := svc.cacheFile(fmt.Sprintf("%s.frame%d.%s", media.Mint, frame, format))
+	release := svc.cache.Acquire(cacheName)
+	defer release()
+
+	ifo, err := os.Stat(cacheName)
+	if err != nil || ifo.Size() == 0 {
+		err := svc.fetchMissingFrame(c.Request.Context(), media, cacheName, frame, format)
+		if err != nil {
+			return err
+		}
+	}
+
+	return svc.writeFile(c, cacheName, imageContentType(format))
+}
+
+// frameCount counts the frames of the cached resized GIF, which keeps every frame of the source, fetching it if not cached yet
+func (svc *ImageService) frameCount(ctx gocontext.Context, media *nft_proxy.Media) (int, error) {
+	data, err := os.ReadFile(svc.cachePath(media))
+	if err != nil || len(data) == 0 {
+		if err := svc.fetchMissingImage(ctx, media); err != nil {
+			return 0, err
+		}
+		if data, err = os.ReadFile(svc.cachePath(media)); err != nil {
+			return 0, err
+		}
+	}
+	return gifFrameCount(data), nil
+}
+
+// cachePath returns the location of the resized image for the media
+func (svc *ImageService) cachePath(media *nft_proxy.Media) string {
+	return svc.cacheFile(fmt.Sprintf("%s.%s", media.Mint, svc.cacheType(media)))
+}
+
+// variantPath returns the location of the resized image at size, the uncropped default size keeps the unsuffixed name.
+// Requested formats always include the size, so theyre never mistaken for a legacy duplicate of the unsuffixed name
+func (svc *ImageService) variantPath(media *nft_proxy.Media, size int, opts ResizeOptions) string {
+	ext := svc.variantType(media, opts)
+	if opts.Crop != CropNone {
+		return svc.cacheFile(fmt.Sprintf("%s.%d.%s.%s", media.Mint, size, opts.Crop, ext))
+	}
+	if size == svc.defaultSize && opts.Format == "" {
+		return svc.cachePath(media)
+	}
+	return svc.cacheFile(fmt.Sprintf("%s.%d.%s", media.Mint, size, ext))
+}
+
+// cacheFile returns the location of a file in the image cache
+func (svc *ImageService) cacheFile(name string) string {
+	return filepath.Join(svc.cacheDir, name)
+}
+
+// cacheType returns the format the resized image is stored in
+func (svc *ImageService) cacheType(media *nft_proxy.Media) string {
+	return outputType(media.ImageType)
+}
+
+// variantType returns the format a variant is stored in, the requested format or else the cacheType
+func (svc *ImageService) variantType(media *nft_proxy.Media, opts ResizeOptions) string {
+	if opts.Format != "" {
+		return opts.Format
+	}
+	return svc.cacheType(media)
+}
+
+func (svc *ImageService) ClearCache(ctx gocontext.Context, key string) error {
+	m, err := svc.solSvc.Media(ctx, key, false)
 	if err != nil {
 		return err
 	}
@@ -110,16 +424,53 @@ func (svc *ImageService) ClearCache(key string) error {
 		return nil
 	}
 
-	cacheName := fmt.Sprintf("./cache/solana/%s.%s", m.Mint, m.ImageType)
-	err = svc.fetchMissingImage(m, cacheName)
+	if m.ImageType == "svg" {
+		_ = os.Remove(svc.cacheFile(fmt.Sprintf("%s.svg", m.Mint)))
+	}
+
+	frames, _ := filepath.Glob(svc.cacheFile(fmt.Sprintf("%s.frame*", m.Mint)))
+	for _, f := range frames {
+		_ = os.Remove(f)
+	}
+
+	//Cropped & explicitly formatted variants are regenerated on request
+	for _, format := range append([]string{""}, OutputFormats...) {
+		for _, crop := range append([]CropMode{CropNone}, CropModes...) {
+			opts := ResizeOptions{Crop: crop, Format: format}
+			if opts == (ResizeOptions{}) {
+				continue
+			}
+			for _, size := range svc.sizes {
+				_ = os.Remove(svc.variantPath(m, size, opts))
+				svc.cache.DropHot(svc.hotKey(m.Mint, size, opts))
+			}
+		}
+	}
+
+	oldType := svc.cacheType(m)
+	oldCache := make([]string, 0, len(svc.sizes))
+	for _, size := range svc.sizes {
+		oldCache = append(oldCache, svc.variantPath(m, size, ResizeOptions{}))
+	}
+
+	err = svc.fetchMissingImage(ctx, m)
 	if err != nil {
 		return err
 	}
 
+	if svc.cacheType(m) != oldType {
+		for _, path := range oldCache {
+			_ = os.Remove(path)
+		}
+	}
+
 	return nil
 }
 
-func (svc *ImageService) writeFile(c *gin.Context, path string, media *nft_proxy.Media) error {
+func (svc *ImageService) writeFile(c *gin.Context, path string, contentType string) error {
+	release := svc.cache.Acquire(path)
+	defer release()
+
 	file, err := os.Open(path)
 	if err != nil {
 		return err
@@ -127,15 +478,14 @@ func (svc *ImageService) writeFile(c *gin.Context, path string, media *nft_proxy
 	defer file.Close()
 
 	ifo, err := file.Stat()
-	modTime := time.Now()
-	if ifo != nil {
-		modTime = ifo.ModTime()
+	if err != nil {
+		return err
 	}
 
-	c.Header("Cache-Control", "public, max=age=172800")
-	c.Header("Vary", "Accept-Encoding")
-	c.Header("Last-Modified", modTime.Format("Mon, 02 Jan 2006 15:04:05 GMT")) //Mon, 03 Jun 2020 11:35:28 GMT
-	c.Header("Content-Type", fmt.Sprintf("image/%s", media.ImageType))
+	etag := fileETag(ifo.ModTime(), ifo.Size())
+	if svc.writeHeaders(c, ifo.ModTime(), etag, contentType) {
+		return nil
+	}
 
 	_, err = io.Copy(c.Writer, file)
 	if err != nil {
@@ -144,6 +494,74 @@ func (svc *ImageService) writeFile(c *gin.Context, path string, media *nft_proxy
 	return nil
 }
 
+// writeHot serves the resized image from disk & keeps it in memory for the following requests
+func (svc *ImageService) writeHot(c *gin.Context, media *nft_proxy.Media, key string, path string, contentType string) error {
+	release := svc.cache.Acquire(path)
+	defer release()
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ifo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	img := &CachedImage{
+		Data:        data,
+		ContentType: contentType,
+		ETag:        fileETag(ifo.ModTime(), ifo.Size()),
+		ModTime:     ifo.ModTime(),
+		Path:        path,
+		Owner:       &nft_proxy.Media{Mint: media.Mint, Collection: media.Collection, UpdateAuthority: media.UpdateAuthority},
+	}
+	svc.cache.KeepHot(key, img)
+
+	return svc.writeCached(c, img)
+}
+
+// writeCached serves an image held in memory
+func (svc *ImageService) writeCached(c *gin.Context, img *CachedImage) error {
+	if svc.writeHeaders(c, img.ModTime, img.ETag, img.ContentType) {
+		return nil
+	}
+
+	_, err := c.Writer.Write(img.Data)
+	return err
+}
+
+// writeHeaders sets the caching headers for a cached image, returning true if the client already has it
+func (svc *ImageService) writeHeaders(c *gin.Context, modTime time.Time, etag string, contentType string) bool {
+	c.Header("Cache-Control", "public, max-age=172800")
+	c.Header("Vary", "Accept-Encoding")
+	c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	c.Header("ETag", etag)
+
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+
+	c.Header("Content-Type", contentType)
+	return false
+}
+
+// writeBlocked serves the moderation replacement image, cached briefly so unblocking takes effect quickly
+func (svc *ImageService) writeBlocked(c *gin.Context) error {
+	data, contentType := svc.blocklist.ReplacementImage()
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, contentType, data)
+	return nil
+}
+
 // func (svc *ImageService) fetchMissingImage(media *nft_proxy.Media, cacheName string) error {
 // 	if media.ImageUri == "" {
 // 		return errors.New("invalid image")
@@ -210,30 +628,195 @@ func (svc *ImageService) writeFile(c *gin.Context, path string, media *nft_proxy
 // 	return nil
 // }
 
-func (svc *ImageService) fetchMissingImage(media *nft_proxy.Media, cacheName string) error {
+// fetchMissingImage downloads & resizes the source image, the media type is updated to the type sniffed from the image bytes
+func (svc *ImageService) fetchMissingImage(ctx gocontext.Context, media *nft_proxy.Media) error {
 	if media.ImageUri == "" {
 		return errors.New("invalid image URI")
 	}
 
 	// Fetch image data
-	data, err := svc.fetchImageData(media.ImageUri)
+	data, err := svc.fetchImageData(ctx, media)
 	if err != nil {
 		return fmt.Errorf("failed to fetch image data: %w", err)
 	}
+	if err := ctx.Err(); err != nil {
+		return err //Client went away, dont spend the resize on it
+	}
+
+	props := map[string]interface{}{}
+	if detected := sniffImageType(data); detected != "" {
+		media.ImageType = detected
+		props["detected_type"] = detected
+	}
 
 	// Save the image to cache
-	if err := svc.saveImageToCache(data, cacheName); err != nil {
+	resized, err := svc.saveImageToCache(ctx, data, media, ResizeOptions{})
+	if errors.Is(err, ErrImageTooLarge) {
+		svc.solSvc.RecordViolation(ctx, media.Mint, nft_proxy.ViolationStageDecode, media.ImageUri, err)
+	}
+	if err != nil {
 		return fmt.Errorf("failed to save image to cache: %w", err)
 	}
 
+	media.Animated = gifFrameCount(data) > 1
+	props["animated"] = media.Animated
+
+	svc.analyzeImage(ctx, media, resized, props)
+	return nil
+}
+
+// ensureAnalyzed derives any missing image properties from the cached image, fetching it if not cached yet
+func (svc *ImageService) ensureAnalyzed(ctx gocontext.Context, media *nft_proxy.Media) error {
+	resized, err := os.ReadFile(svc.cachePath(media))
+	if err != nil || len(resized) == 0 {
+		return svc.fetchMissingImage(ctx, media)
+	}
+
+	svc.analyzeImage(ctx, media, resized, map[string]interface{}{})
 	return nil
 }
 
-func (svc *ImageService) fetchImageData(uri string) ([]byte, error) {
+// analyzeImage derives the placeholder, palette & perceptual hash from the resized image & stores them against the mint
+func (svc *ImageService) analyzeImage(ctx gocontext.Context, media *nft_proxy.Media, resized []byte, props map[string]interface{}) {
+	if hash, err := svc.resize.BlurHash(resized); err == nil {
+		media.BlurHash = hash
+		props["blur_hash"] = hash
+	} else {
+		svc.logger.WarnContext(ctx, "BlurHash failed", "mint", media.Mint, "err", err)
+	}
+
+	if dominant, palette, err := svc.resize.Palette(resized); err == nil {
+		media.DominantColor, media.Palette = dominant, palette
+		props["dominant_color"] = dominant
+		props["palette"] = strings.Join(palette, ",")
+	} else {
+		svc.logger.WarnContext(ctx, "Palette failed", "mint", media.Mint, "err", err)
+	}
+
+	if err := svc.solSvc.SetImageProperties(media.Mint, props); err != nil {
+		svc.logger.ErrorContext(ctx, "Saving image properties failed", "mint", media.Mint, "err", err)
+	}
+
+	if hash, err := svc.resize.PerceptualHash(resized); err == nil {
+		media.PHash = fmt.Sprintf("%016x", hash)
+		if err := svc.solSvc.IndexHash(media.Mint, hash); err != nil {
+			svc.logger.ErrorContext(ctx, "Indexing perceptual hash failed", "mint", media.Mint, "err", err)
+		}
+	} else {
+		svc.logger.WarnContext(ctx, "Perceptual hash failed", "mint", media.Mint, "err", err)
+	}
+}
+
+// fetchMissingVariant downloads the source image & writes every variant size with the given crop & format
+func (svc *ImageService) fetchMissingVariant(ctx gocontext.Context, media *nft_proxy.Media, opts ResizeOptions) error {
+	if media.ImageUri == "" {
+		return errors.New("invalid image URI")
+	}
+
+	data, err := svc.fetchImageData(ctx, media)
+	if err != nil {
+		return fmt.Errorf("failed to fetch image data: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if detected := sniffImageType(data); detected != "" {
+		media.ImageType = detected //Name the files by what the encoder will write
+	}
+
+	_, err = svc.saveImageToCache(ctx, data, media, opts)
+	if errors.Is(err, ErrImageTooLarge) {
+		svc.solSvc.RecordViolation(ctx, media.Mint, nft_proxy.ViolationStageDecode, media.ImageUri, err)
+	}
+	return err
+}
+
+func (svc *ImageService) fetchMissingFrame(ctx gocontext.Context, media *nft_proxy.Media, cacheName string, frame int, format string) error {
+	if media.ImageUri == "" {
+		return errors.New("invalid image URI")
+	}
+
+	data, err := svc.fetchImageData(ctx, media)
+	if err != nil {
+		return fmt.Errorf("failed to fetch image data: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	output, err := os.Create(cacheName)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+
+	err = svc.resize.ResizeFrame(ctx, data, output, svc.defaultSize, frame, format)
+	if errors.Is(err, ErrImageTooLarge) {
+		svc.solSvc.RecordViolation(ctx, media.Mint, nft_proxy.ViolationStageDecode, media.ImageUri, err)
+	}
+	if err != nil {
+		return err
+	}
+	svc.cache.Stored(cacheName)
+	return nil
+}
+
+func (svc *ImageService) fetchMissingVector(ctx gocontext.Context, media *nft_proxy.Media, cacheName string) error {
+	if media.ImageUri == "" {
+		return errors.New("invalid image URI")
+	}
+
+	data, err := svc.fetchImageData(ctx, media)
+	if err != nil {
+		return fmt.Errorf("failed to fetch image data: %w", err)
+	}
+
+	if !isSVG(data) {
+		return errors.New("source image is not an svg")
+	}
+
+	clean, err := sanitizeSVG(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(cacheName, clean, 0644); err != nil {
+		return err
+	}
+	svc.cache.Stored(cacheName)
+	return nil
+}
+
+// fetchImageData returns the source image for the media, decoding inline data URIs & downloading anything else
+func (svc *ImageService) fetchImageData(ctx gocontext.Context, media *nft_proxy.Media) ([]byte, error) {
+	uri := media.ImageUri
 	if strings.Contains(uri, nft_proxy.BASE64_PREFIX) {
 		return svc.decodeBase64Image(uri)
 	}
-	return svc.fetchImageFromURL(uri)
+	if strings.HasPrefix(uri, nft_proxy.DATA_URI_PREFIX) {
+		return svc.decodeDataURI(uri)
+	}
+
+	data, err := svc.fetchImageFromURL(ctx, uri)
+	if IsFetchViolation(err) {
+		svc.solSvc.RecordViolation(ctx, media.Mint, nft_proxy.ViolationStageFetch, uri, err)
+	}
+	return data, err
+}
+
+// decodeDataURI decodes plain (non-base64) data URIs, commonly used for on-chain SVGs.
+// Payloads that arent percent encoded (e.g width="100%") are used as is
+func (svc *ImageService) decodeDataURI(uri string) ([]byte, error) {
+	v := strings.Index(uri, ",")
+	if v < 0 {
+		return nil, errors.New("invalid data uri")
+	}
+
+	data, err := url.PathUnescape(uri[v+1:])
+	if err != nil {
+		return []byte(uri[v+1:]), nil
+	}
+	return []byte(data), nil
 }
 
 func (svc *ImageService) decodeBase64Image(base64String string) ([]byte, error) {
@@ -243,66 +826,254 @@ func (svc *ImageService) decodeBase64Image(base64String string) ([]byte, error)
 	return base64.StdEncoding.DecodeString(base64String)
 }
 
-func (svc *ImageService) fetchImageFromURL(uri string) ([]byte, error) {
+func (svc *ImageService) fetchImageFromURL(ctx gocontext.Context, uri string) (_ []byte, err error) {
+	ctx, span := tracer.Start(ctx, "ImageService.fetchImageFromURL", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
 	uri = strings.Replace(strings.TrimSpace(uri), ".ipfs.nftstorage.link", ".ipfs.w3s.link", 1)
-	req, err := http.NewRequest("GET", uri, nil)
+	u, err := url.Parse(uri)
 	if err != nil {
 		return nil, err
 	}
+	span.SetAttributes(semconv.ServerAddress(u.Host))
 
-	req.Header.Set("User-Agent", "PostmanRuntime/7.29.2")
-	resp, err := svc.httpMedia.Do(req)
-	if err != nil {
-		return nil, err
+	data, resp, err := svc.httpMedia.Get(ctx, uri, contentImage)
+	if resp != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		svc.logger.DebugContext(ctx, "Fetched image", "host", u.Host, "status", resp.StatusCode)
 	}
-	defer resp.Body.Close()
+	return data, err
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.New(resp.Status)
-	}
+// saveImageToCache resizes the image into every variant size from a single decode & returns the default size bytes.
+// Variants are written to temp files & only replace the cached files once all succeed, so readers never see a partial file
+func (svc *ImageService) saveImageToCache(ctx gocontext.Context, data []byte, media *nft_proxy.Media, opts ResizeOptions) ([]byte, error) {
+	temps := make(map[int]*os.File, len(svc.sizes))
+	defer func() {
+		for _, tmp := range temps {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
 
-	return io.ReadAll(resp.Body)
-}
+	var resized bytes.Buffer
+	outs := make(map[int]io.Writer, len(svc.sizes))
+	for _, size := range svc.sizes {
+		tmp, err := os.CreateTemp(svc.cacheDir, cacheTempPrefix+"*")
+		if err != nil {
+			return nil, err
+		}
+		temps[size] = tmp
+
+		outs[size] = tmp
+		if size == svc.defaultSize {
+			outs[size] = io.MultiWriter(tmp, &resized)
+		}
+	}
 
-func (svc *ImageService) saveImageToCache(data []byte, path string) error {
-	output, err := os.Create(path)
+	err := svc.resize.ResizeVariants(ctx, data, outs, opts)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer output.Close()
 
-	return svc.resize.Resize(data, output, svc.defaultSize)
+	defer func() { //The files are replaced, the next requests reload them
+		for _, size := range svc.sizes {
+			svc.cache.DropHot(svc.hotKey(media.Mint, size, opts))
+		}
+	}()
+	for _, size := range svc.sizes {
+		tmp := temps[size]
+		if err := tmp.Close(); err != nil {
+			return nil, err
+		}
+		path := svc.variantPath(media, size, opts)
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return nil, err
+		}
+		delete(temps, size)
+		svc.cache.Stored(path)
+	}
+	return resized.Bytes(), nil
 }
 
 func (svc *ImageService) mediaFile(c *gin.Context, key string) error {
 	var media *nft_proxy.Media
 	var err error
 	if svc.IsSolKey(key) {
-		media, err = svc.solSvc.Media(key, false)
+		media, err = svc.solSvc.Media(c.Request.Context(), key, false)
 		if err != nil {
 			return err
 		}
 	}
 
+	if media == nil {
+		return errors.New("unsupported chain")
+	}
+
+	if svc.blocklist.IsBlocked(media) {
+		return svc.writeBlocked(c)
+	}
+
 	if media.MediaUri == "" {
 		return errors.New("no media for mint")
 	}
 
-	resp, err := svc.httpMedia.Get(media.MediaUri)
+	resp, err := svc.httpStream.Open(c.Request.Context(), media.MediaUri, contentMedia)
 	if err != nil {
+		if IsFetchViolation(err) {
+			svc.solSvc.RecordViolation(c.Request.Context(), media.Mint, nft_proxy.ViolationStageFetch, media.MediaUri, err)
+		}
 		return err
 	}
+	defer resp.Body.Close()
 
 	//Write our data
-	c.Header("Cache-Control", "public, max-age=31536000")
-	c.Header("Expires", time.Now().AddDate(0, 1, 0).Format(http.TimeFormat))
-	c.Header("Content-Type", media.MediaType)
-	err = resp.Write(c.Writer)
+	c.Header("Cache-Control", "public, max-age=172800")
+	c.Header("Expires", time.Now().AddDate(0, 0, 2).Format(http.TimeFormat))
+	c.Header("Content-Type", mediaContentType(resp.Header.Get("Content-Type"), media.MediaType))
+	c.Header("X-Content-Type-Options", "nosniff")
+	if resp.ContentLength >= 0 {
+		c.Header("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+	c.Status(http.StatusOK)
+	_, err = io.Copy(c.Writer, resp.Body)
 	if err != nil {
-		return err
+		abortResponse(c)
 	}
+	if errors.Is(err, ErrBodyTooLarge) {
+		svc.solSvc.RecordViolation(c.Request.Context(), media.Mint, nft_proxy.ViolationStageFetch, media.MediaUri, err)
+	}
+	return err
+}
 
-	return nil
+// mediaContentType returns the Content-Type to serve proxied media as. Gateways that dont know the type fall back to the
+// type declared in the metadata, which is creator controlled so must also be a media type (never e.g text/html)
+func mediaContentType(upstream string, declared string) string {
+	if !unknownContentType(upstream) {
+		return upstream //Already checked by SafeClient.Open
+	}
+	if !unknownContentType(declared) && contentMedia.accepts(declared) {
+		return declared
+	}
+	return "application/octet-stream"
+}
+
+// abortResponse closes the connection mid body, so clients & caches see a truncated transfer rather than a complete response
+func abortResponse(c *gin.Context) {
+	if conn, _, err := c.Writer.Hijack(); err == nil {
+		_ = conn.Close()
+	}
+}
+
+// BackfillImageProperties derives the placeholder, palette & perceptual hash of images cached before they were computed,
+// images not cached yet are skipped as theyre analyzed when fetched. Returns the number of images analyzed
+func (svc *ImageService) BackfillImageProperties(ctx gocontext.Context) (int, error) {
+	var analyzed int
+	err := svc.store.EachMedia(MediaFilter{MissingBlurHash: true}, 500, func(rows []*nft_proxy.SolanaMedia) error {
+		for _, m := range rows {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			media := m.Media()
+			resized, err := os.ReadFile(svc.cachePath(media))
+			if err != nil || len(resized) == 0 {
+				continue
+			}
+			svc.analyzeImage(ctx, media, resized, map[string]interface{}{})
+			analyzed++
+		}
+		return nil
+	})
+	return analyzed, err
+}
+
+// ReconcileImageTypes sniffs images cached before types were detected from the image bytes,
+// renaming cached files to their real type & removing duplicates left by differing guesses (.jpg/.jpeg).
+// Files are moved under any reader, so this must run while nothing is serving from the cache dir. Returns the number of images reconciled
+func (svc *ImageService) ReconcileImageTypes(ctx gocontext.Context) (int, error) {
+	var reconciled int
+	err := svc.store.EachMedia(MediaFilter{MissingDetectedType: true}, 500, func(rows []*nft_proxy.SolanaMedia) error {
+		for _, m := range rows {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			detected := svc.reconcileCachedFile(m.Mint)
+			if detected == "" {
+				continue //Not cached yet, will be sniffed on fetch
+			}
+			if m.ImageType == "svg" && detected == "png" {
+				detected = "svg" //Rasterized
+			}
+
+			props := map[string]interface{}{"detected_type": detected}
+			if detected == "gif" {
+				data, err := os.ReadFile(svc.cacheFile(m.Mint + ".gif"))
+				if err == nil {
+					props["animated"] = gifFrameCount(data) > 1
+				}
+			}
+
+			err := svc.solSvc.SetImageProperties(m.Mint, props)
+			if err != nil {
+				return err
+			}
+			reconciled++
+		}
+		return nil
+	})
+	return reconciled, err
+}
+
+// reconcileCachedFile keeps the newest cached image for the mint under its sniffed type & returns that type
+func (svc *ImageService) reconcileCachedFile(mint string) string {
+	var newest string
+	var newestMod time.Time
+	candidates := []string{"jpg", "jpeg", "png", "gif"}
+	for _, ext := range candidates {
+		path := svc.cacheFile(fmt.Sprintf("%s.%s", mint, ext))
+		ifo, err := os.Stat(path)
+		if err != nil || ifo.Size() == 0 {
+			continue
+		}
+		if newest == "" || ifo.ModTime().After(newestMod) {
+			newest, newestMod = path, ifo.ModTime()
+		}
+	}
+	if newest == "" {
+		return ""
+	}
+
+	f, err := os.Open(newest)
+	if err != nil {
+		return ""
+	}
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+
+	detected := sniffImageType(head[:n])
+	if detected == "" {
+		return ""
+	}
+
+	target := svc.cacheFile(fmt.Sprintf("%s.%s", mint, outputType(detected)))
+	if newest != target {
+		if err := os.Rename(newest, target); err != nil {
+			svc.logger.Error("Renaming cached file failed", "mint", mint, "err", err)
+			return ""
+		}
+	}
+
+	for _, ext := range candidates {
+		path := svc.cacheFile(fmt.Sprintf("%s.%s", mint, ext))
+		if path != target {
+			_ = os.Remove(path)
+		}
+	}
+
+	return detected
 }
 
 func (svc *ImageService) IsSolKey(key string) bool {
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+)
+
+func TestVariantSize(t *testing.T) {
+	svc := &ImageService{defaultSize: 720, sizes: variantSizes([]int{256, 64, 256, 128}, 720)}
+	if !slices.Equal(svc.sizes, []int{64, 128, 256, 720}) {
+		t.Fatalf("unexpected sizes %v", svc.sizes)
+	}
+
+	for requested, want := range map[string]int{
+		"":     720,
+		"abc":  720,
+		"-5":   720,
+		"64":   64,
+		"100":  128,
+		"300":  720,
+		"4000": 720,
+	} {
+		if got := svc.variantSize(requested); got != want {
+			t.Errorf("variantSize(%q) = %v, want %v", requested, got, want)
+		}
+	}
+	if h := svc.VariantHeight(&nft_proxy.Media{ImageType: "gif"}, 256); h != 128 {
+		t.Errorf("expected gif variants at half height, got %v", h)
+	}
+	if h := svc.VariantHeight(&nft_proxy.Media{ImageType: "png"}, 256); h != 256 {
+		t.Errorf("expected png variants at full height, got %v", h)
+	}
+}
+
+func TestMediaContentType(t *testing.T) {
+	for _, tc := range []struct{ upstream, declared, want string }{
+		{"video/mp4", "text/html", "video/mp4"},
+		{"", "video/mp4", "video/mp4"},
+		{"application/octet-stream", "model/gltf-binary", "model/gltf-binary"},
+		{"", "text/html", "application/octet-stream"},
+		{"binary/octet-stream", "", "application/octet-stream"},
+	} {
+		if got := mediaContentType(tc.upstream, tc.declared); got != tc.want {
+			t.Errorf("mediaContentType(%q, %q) = %q, want %q", tc.upstream, tc.declared, got, tc.want)
+		}
+	}
+}
+
+func TestImageFormat(t *testing.T) {
+	for _, tc := range []struct{ query, ext, want string }{
+		{"", "", ""},
+		{"webp", "", "webp"},
+		{"", "png", "png"},
+		{"PNG", "png", "png"},
+	} {
+		if got, err := imageFormat(tc.query, tc.ext); err != nil || got != tc.want {
+			t.Errorf("imageFormat(%q, %q) = %q, %v", tc.query, tc.ext, got, err)
+		}
+	}
+	for _, tc := range []struct{ query, ext string }{{"jpg", "png"}, {"svg", ""}} {
+		if _, err := imageFormat(tc.query, tc.ext); !errors.Is(err, ErrInvalidImageFormat) {
+			t.Errorf("imageFormat(%q, %q): expected ErrInvalidImageFormat, got %v", tc.query, tc.ext, err)
+		}
+	}
+}
+
+func TestDecodeDataURI(t *testing.T) {
+	svc := &ImageService{}
+	for uri, want := range map[string]string{
+		`data:image/svg+xml;utf8,%3Csvg%20width%3D%22100%25%22%3E`: `<svg width="100%">`,
+		`data:image/svg+xml;utf8,<svg width="100%">`:               `<svg width="100%">`,
+		`data:image/svg+xml,<svg><text>50% off</text></svg>`:       `<svg><text>50% off</text></svg>`,
+	} {
+		got, err := svc.decodeDataURI(uri)
+		if err != nil || string(got) != want {
+			t.Errorf("decodeDataURI(%q) = %q, %v", uri, got, err)
+		}
+	}
+}
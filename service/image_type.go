@@ -0,0 +1,92 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// sniffImageType detects the image format from the magic bytes of the data.
+// Returns an empty string if the format is unknown
+func sniffImageType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "bmp"
+	case isSVG(data):
+		return "svg"
+	}
+
+	//Fallback to the std lib sniffer for anything else it knows about
+	ct := http.DetectContentType(data)
+	if strings.HasPrefix(ct, "image/") {
+		return normalizeImageType(strings.TrimPrefix(ct, "image/"))
+	}
+	return ""
+}
+
+// normalizeImageType maps the various names used for the same format onto one
+func normalizeImageType(imageType string) string {
+	imageType = strings.ToLower(strings.TrimSpace(imageType))
+	switch imageType {
+	case "jpeg", "jpg", "pjpeg":
+		return "jpg"
+	case "svg+xml":
+		return "svg"
+	case "x-icon", "vnd.microsoft.icon":
+		return "ico"
+	}
+	return imageType
+}
+
+// outputType returns the format ResizeService encodes a source of the given type to
+func outputType(imageType string) string {
+	switch normalizeImageType(imageType) {
+	case "png", "svg":
+		return "png"
+	case "gif":
+		return "gif"
+	default:
+		return "jpg"
+	}
+}
+
+// imageContentType returns the Content-Type header for a cached image type
+func imageContentType(imageType string) string {
+	switch normalizeImageType(imageType) {
+	case "jpg":
+		return "image/jpeg"
+	case "svg":
+		return "image/svg+xml"
+	default:
+		return "image/" + imageType
+	}
+}
+
+// OutputFormats are the formats images can be requested in, each is cached as its own variant
+var OutputFormats = []string{"jpg", "png", "webp", "gif"}
+
+var ErrInvalidImageFormat = errors.New("invalid image format")
+
+// ParseOutputFormat validates an image format from a request, empty keeps the format chosen from the source
+func ParseOutputFormat(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	format := normalizeImageType(s)
+	for _, f := range OutputFormats {
+		if f == format {
+			return format, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidImageFormat, s)
+}
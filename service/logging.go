@@ -0,0 +1,171 @@
+package services
+
+import (
+	gocontext "context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// LogConfig controls the structured logger, Levels overrides Level for individual subsystems (e.g. http: debug)
+type LogConfig struct {
+	Level  string            `yaml:"level" toml:"level"`
+	Format string            `yaml:"format" toml:"format"` // json or text
+	Levels map[string]string `yaml:"levels" toml:"levels"`
+}
+
+// Logging subsystems, each service logs under its own so its level can be tuned independently
+const (
+	LOG_HTTP       = "http"
+	LOG_IMAGE      = "image"
+	LOG_RESIZE     = "resize"
+	LOG_SOLANA     = "solana"
+	LOG_SOLANA_IMG = "solana_img"
+	LOG_STORAGE    = "storage"
+	LOG_BLOCKLIST  = "blocklist"
+	LOG_TRACING    = "tracing"
+	LOG_CACHE      = "cache"
+)
+
+var logSubsystems = []string{LOG_HTTP, LOG_IMAGE, LOG_RESIZE, LOG_SOLANA, LOG_SOLANA_IMG, LOG_STORAGE, LOG_BLOCKLIST, LOG_TRACING, LOG_CACHE}
+
+var logging = struct {
+	sync.RWMutex
+	handler slog.Handler
+	level   slog.Level
+	levels  map[string]slog.Level
+}{
+	handler: slog.Default().Handler(),
+	level:   slog.LevelInfo,
+}
+
+// SetupLogging replaces the default logger with one writing to w in the configured format,
+// the std log package is routed through it so remaining log.Printf calls are structured too
+func SetupLogging(cfg LogConfig, w io.Writer) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	levels := make(map[string]slog.Level, len(cfg.Levels))
+	for name, l := range cfg.Levels {
+		levels[name], err = parseLogLevel(l)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	//Filtering happens in levelHandler so subsystems can go below the default level
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	switch cfg.Format {
+	case "", "json":
+		h = slog.NewJSONHandler(w, opts)
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format: %s", cfg.Format)
+	}
+
+	logging.Lock()
+	logging.handler = h
+	logging.level = level
+	logging.levels = levels
+	logging.Unlock()
+
+	slog.SetDefault(slog.New(&levelHandler{Handler: h, level: level}))
+	return nil
+}
+
+// Logger returns the logger for a subsystem, call it after SetupLogging (e.g. in Start)
+func Logger(subsystem string) *slog.Logger {
+	logging.RLock()
+	defer logging.RUnlock()
+
+	level, ok := logging.levels[subsystem]
+	if !ok {
+		level = logging.level
+	}
+	return slog.New(&levelHandler{
+		Handler: logging.handler.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)}),
+		level:   level,
+	})
+}
+
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if s == "" {
+		return slog.LevelInfo, nil
+	}
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("invalid log level %q", s)
+	}
+	return l, nil
+}
+
+// levelHandler applies a subsystem's level & attaches the request & trace IDs carried by the context
+type levelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h *levelHandler) Enabled(_ gocontext.Context, l slog.Level) bool {
+	return l >= h.level
+}
+
+func (h *levelHandler) Handle(ctx gocontext.Context, r slog.Record) error {
+	if id := RequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the request ID, it is attached to every log line written with the context
+func WithRequestID(ctx gocontext.Context, id string) gocontext.Context {
+	return gocontext.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID carried by the context, empty if there is none
+func RequestID(ctx gocontext.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// NewRequestID returns a random 16 character hex ID
+func NewRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks a client supplied ID is safe to log & echo back
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	return strings.IndexFunc(id, func(r rune) bool {
+		return !(r == '-' || r == '_' || r == '.' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z'))
+	}) == -1
+}
@@ -0,0 +1,53 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLoggerSubsystemLevels(t *testing.T) {
+	defaultLogger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(defaultLogger) })
+
+	var buf bytes.Buffer
+	err := SetupLogging(LogConfig{Level: "warn", Format: "json", Levels: map[string]string{LOG_HTTP: "debug"}}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	Logger(LOG_HTTP).DebugContext(ctx, "http debug")
+	Logger(LOG_SOLANA).InfoContext(ctx, "solana info")
+	Logger(LOG_SOLANA).WarnContext(ctx, "solana warn")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %v:\n%s", len(lines), buf.String())
+	}
+
+	var line map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	if line["msg"] != "http debug" || line["subsystem"] != LOG_HTTP || line["request_id"] != "req-1" {
+		t.Fatalf("unexpected log line: %s", lines[0])
+	}
+}
+
+func TestValidRequestID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"":                      false,
+		"abc-123_DEF.4":         true,
+		"has space":             false,
+		"new\nline":             false,
+		strings.Repeat("a", 65): false,
+	} {
+		if got := validRequestID(id); got != want {
+			t.Errorf("validRequestID(%q) = %v, want %v", id, got, want)
+		}
+	}
+}
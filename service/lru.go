@@ -0,0 +1,124 @@
+package services
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+)
+
+// CachedImage is a resized image held in memory with everything needed to serve it without touching disk or the DB
+type CachedImage struct {
+	Data        []byte
+	ContentType string
+	ETag        string
+	ModTime     time.Time
+	Path        string //File the image was read from
+
+	Owner *nft_proxy.Media //Mint, collection & update authority, so blocks still apply to cached images
+}
+
+// fileETag identifies a cached file by its modtime & size, which change whenever the file is rewritten
+func fileETag(modTime time.Time, size int64) string {
+	return fmt.Sprintf(`"%x-%x"`, modTime.UnixNano(), size)
+}
+
+// imageLRU is a least recently used set of images bounded by the total bytes held
+type imageLRU struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	order    *list.List //Front is most recently used
+	items    map[string]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+type lruItem struct {
+	key   string
+	image *CachedImage
+}
+
+func newImageLRU(capacity int64) *imageLRU {
+	return &imageLRU{
+		capacity: capacity,
+		order:    list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// Get returns the image for key, marking it most recently used
+func (l *imageLRU) Get(key string) (*CachedImage, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		l.misses++
+		return nil, false
+	}
+	l.hits++
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem).image, true
+}
+
+// Add stores the image under key, evicting the least recently used images to stay within capacity.
+// Images larger than an eighth of the capacity arent kept so one large image cant flush the hot set
+func (l *imageLRU) Add(key string, img *CachedImage) {
+	size := int64(len(img.Data))
+	if size > l.capacity/8 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remove(key)
+	l.items[key] = l.order.PushFront(&lruItem{key: key, image: img})
+	l.size += size
+
+	for l.size > l.capacity {
+		l.remove(l.order.Back().Value.(*lruItem).key)
+	}
+}
+
+// Remove drops the image for key
+func (l *imageLRU) Remove(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.remove(key)
+}
+
+// remove must be called with mu held
+func (l *imageLRU) remove(key string) {
+	el, ok := l.items[key]
+	if !ok {
+		return
+	}
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= int64(len(el.Value.(*lruItem).image.Data))
+}
+
+// Stats reports the memory held & the hit rate since start
+func (l *imageLRU) Stats() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hitRate := 0.0
+	if total := l.hits + l.misses; total > 0 {
+		hitRate = float64(l.hits) / float64(total)
+	}
+
+	return map[string]interface{}{
+		"memoryCacheEntries": len(l.items),
+		"memoryCacheBytes":   l.size,
+		"memoryCacheHits":    l.hits,
+		"memoryCacheMisses":  l.misses,
+		"memoryCacheHitRate": hitRate,
+	}
+}
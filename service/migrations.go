@@ -0,0 +1,441 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration is a versioned schema change, each runs in its own transaction along with its version row
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// MigrationState is a migration & when it was applied, AppliedAt is nil while pending
+type MigrationState struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+var ErrUnknownMigration = errors.New("unknown migration version")
+
+// migrationLockKey is the Postgres advisory lock held while migrating, an arbitrary app wide constant
+const migrationLockKey = 0x6e66745f70726f78
+
+// migrations are applied in order, never edit or reorder one that has shipped - add a new version instead.
+// Models are snapshotted in each migration so later changes to the structs dont alter old migrations.
+// Columns derived from cached images cant be filled in SQL, `go run cli/migrate.go backfill` fills them for existing rows
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		//Databases created by the previous AutoMigrate already match, AutoMigrate only adds whats missing
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&solanaMediaV1{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&solanaMediaV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "media_animated",
+		Up: func(tx *gorm.DB) error {
+			return addColumns(tx, &solanaMediaV2{}, "Animated")
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, &solanaMediaV2{}, "Animated")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "media_detected_type",
+		Up: func(tx *gorm.DB) error {
+			return addColumns(tx, &solanaMediaV3{}, "DetectedType")
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, &solanaMediaV3{}, "DetectedType")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "media_blur_hash",
+		Up: func(tx *gorm.DB) error {
+			return addColumns(tx, &solanaMediaV4{}, "BlurHash")
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, &solanaMediaV4{}, "BlurHash")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "media_palette",
+		Up: func(tx *gorm.DB) error {
+			return addColumns(tx, &solanaMediaV5{}, "DominantColor", "Palette")
+		},
+		Down: func(tx *gorm.DB) error {
+			return dropColumns(tx, &solanaMediaV5{}, "DominantColor", "Palette")
+		},
+	},
+	{
+		Version: 6,
+		Name:    "media_perceptual_hash",
+		Up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &solanaMediaV6{}, "PHash"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&mediaHashBandV6{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&mediaHashBandV6{}); err != nil {
+				return err
+			}
+			return dropColumns(tx, &solanaMediaV6{}, "PHash")
+		},
+	},
+	{
+		Version: 7,
+		Name:    "blocklist",
+		//Existing rows get their collection when their metadata is next refreshed (cli/reload_hashlist.go -mode metadata)
+		Up: func(tx *gorm.DB) error {
+			if err := addColumns(tx, &solanaMediaV7{}, "Collection"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&blockedMediaV7{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&blockedMediaV7{}); err != nil {
+				return err
+			}
+			return dropColumns(tx, &solanaMediaV7{}, "Collection")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "media_authority_collection_indexes",
+		Up: func(tx *gorm.DB) error {
+			err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_solana_media_update_authority ON solana_media (update_authority)").Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("CREATE INDEX IF NOT EXISTS idx_solana_media_collection ON solana_media (collection)").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			err := tx.Exec("DROP INDEX IF EXISTS idx_solana_media_collection").Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("DROP INDEX IF EXISTS idx_solana_media_update_authority").Error
+		},
+	},
+	{
+		Version: 9,
+		Name:    "media_violations",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&mediaViolationV9{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&mediaViolationV9{})
+		},
+	},
+}
+
+// LatestMigration returns the version of the newest migration
+func LatestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// MigrationStatus returns every migration & whether its been applied
+func (s *gormStorage) MigrationStatus() ([]*MigrationState, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*MigrationState, len(migrations))
+	for i, m := range migrations {
+		out[i] = &MigrationState{Version: m.Version, Name: m.Name}
+		if a, ok := applied[m.Version]; ok {
+			appliedAt := a.AppliedAt
+			out[i].AppliedAt = &appliedAt
+		}
+	}
+	return out, nil
+}
+
+// SchemaVersion returns the highest applied migration, 0 for a new database
+func (s *gormStorage) SchemaVersion() (int, error) {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// MigrateUp applies pending migrations up to & including target, 0 for the latest
+func (s *gormStorage) MigrateUp(target int) error {
+	if target == 0 {
+		target = LatestMigration()
+	}
+	if target > LatestMigration() {
+		return fmt.Errorf("%w: %v", ErrUnknownMigration, target)
+	}
+
+	return s.lockMigrations(func() error {
+		applied, err := s.appliedMigrations()
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			if m.Version > target {
+				break
+			}
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			err := s.db.Transaction(func(tx *gorm.DB) error {
+				if done, err := migrationApplied(tx, m.Version); done || err != nil {
+					return err
+				}
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %v %s failed: %w", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateDown reverts applied migrations newer than target, 0 reverts everything
+func (s *gormStorage) MigrateDown(target int) error {
+	if target < 0 || target > LatestMigration() {
+		return fmt.Errorf("%w: %v", ErrUnknownMigration, target)
+	}
+
+	return s.lockMigrations(func() error {
+		applied, err := s.appliedMigrations()
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if m.Version <= target {
+				break
+			}
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+
+			err := s.db.Transaction(func(tx *gorm.DB) error {
+				if done, err := migrationApplied(tx, m.Version); !done || err != nil {
+					return err
+				}
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{}, "version = ?", m.Version).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %v %s rollback failed: %w", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// lockMigrations runs fn while holding a lock across processes, so replicas starting together dont apply a migration twice.
+// Postgres holds an advisory lock on one connection of the pool. SQLite transactions take the write lock as they begin
+// (see sqliteDSN), so each migration rechecks its version within its transaction instead
+func (s *gormStorage) lockMigrations(fn func() error) error {
+	if s.db.Dialector.Name() != DB_DRIVER_POSTGRES {
+		return fn()
+	}
+
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer func() { _, _ = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey) }()
+
+	return fn()
+}
+
+// migrationApplied reports whether the version has been recorded, read within the migration's transaction
+func migrationApplied(tx *gorm.DB, version int) (bool, error) {
+	var n int64
+	err := tx.Model(&SchemaMigration{}).Where("version = ?", version).Count(&n).Error
+	return n > 0, err
+}
+
+// addColumns adds the snapshot fields missing from its table
+func addColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, f := range fields {
+		if tx.Migrator().HasColumn(model, f) {
+			continue
+		}
+		if err := tx.Migrator().AddColumn(model, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropColumns removes the snapshot fields from its table
+func dropColumns(tx *gorm.DB, model interface{}, fields ...string) error {
+	for _, f := range fields {
+		if !tx.Migrator().HasColumn(model, f) {
+			continue
+		}
+		if err := tx.Migrator().DropColumn(model, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *gormStorage) appliedMigrations() (map[int]*SchemaMigration, error) {
+	//In a transaction so SQLite processes creating the table together are serialized
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		return tx.AutoMigrate(&SchemaMigration{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	var rows []*SchemaMigration
+	err = s.db.Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	applied := make(map[int]*SchemaMigration, len(rows))
+	for _, r := range rows {
+		applied[r.Version] = r
+	}
+	return applied, nil
+}
+
+// Schema snapshots, each holds only what its migration adds
+
+type solanaMediaV1 struct {
+	ID              uint   `gorm:"primaryKey"`
+	Mint            string `gorm:"uniqueIndex"`
+	MintDecimals    uint8
+	ImageUri        string
+	ImageType       string
+	MediaUri        string
+	MediaType       string
+	LocalPath       string
+	Name            string
+	Symbol          string
+	UpdateAuthority string
+	CreatedAt       time.Time
+}
+
+func (solanaMediaV1) TableName() string { return "solana_media" }
+
+type solanaMediaV2 struct {
+	Animated bool
+}
+
+func (solanaMediaV2) TableName() string { return "solana_media" }
+
+type solanaMediaV3 struct {
+	DetectedType string
+}
+
+func (solanaMediaV3) TableName() string { return "solana_media" }
+
+type solanaMediaV4 struct {
+	BlurHash string
+}
+
+func (solanaMediaV4) TableName() string { return "solana_media" }
+
+type solanaMediaV5 struct {
+	DominantColor string
+	Palette       string
+}
+
+func (solanaMediaV5) TableName() string { return "solana_media" }
+
+type solanaMediaV6 struct {
+	PHash string
+}
+
+func (solanaMediaV6) TableName() string { return "solana_media" }
+
+type mediaHashBandV6 struct {
+	Mint  string `gorm:"primaryKey"`
+	Band  uint8  `gorm:"primaryKey;index:idx_hash_band_value,priority:1"`
+	Value uint8  `gorm:"index:idx_hash_band_value,priority:2"`
+}
+
+func (mediaHashBandV6) TableName() string { return "media_hash_bands" }
+
+type solanaMediaV7 struct {
+	Collection string
+}
+
+func (solanaMediaV7) TableName() string { return "solana_media" }
+
+type blockedMediaV7 struct {
+	ID        uint   `gorm:"primaryKey"`
+	Kind      string `gorm:"uniqueIndex:idx_blocked_kind_key"`
+	Key       string `gorm:"uniqueIndex:idx_blocked_kind_key"`
+	Reason    string
+	CreatedAt time.Time
+}
+
+func (blockedMediaV7) TableName() string { return "blocked_media" }
+
+type mediaViolationV9 struct {
+	ID        uint   `gorm:"primaryKey"`
+	Mint      string `gorm:"uniqueIndex:idx_violation_mint_stage"`
+	Stage     string `gorm:"uniqueIndex:idx_violation_mint_stage"`
+	Url       string
+	Reason    string
+	Count     int
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (mediaViolationV9) TableName() string { return "media_violations" }
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+const (
+	// PaletteSize is the number of colors extracted per image
+	PaletteSize = 5
+	// paletteIterations caps the k-means refinement passes
+	paletteIterations = 10
+)
+
+type paletteColor [3]float64
+
+func (c paletteColor) dist(o paletteColor) float64 {
+	dr, dg, db := c[0]-o[0], c[1]-o[1], c[2]-o[2]
+	return dr*dr + dg*dg + db*db
+}
+
+func (c paletteColor) hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", uint8(math.Round(c[0])), uint8(math.Round(c[1])), uint8(math.Round(c[2])))
+}
+
+// extractPalette clusters the opaque pixels of the image with k-means & returns the cluster colors as hex,
+// ordered by how much of the image they cover. The first entry is the dominant color
+func extractPalette(img image.Image, k int) []string {
+	var pixels []paletteColor
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue //Ignore transparent pixels
+			}
+			pixels = append(pixels, paletteColor{float64(r >> 8), float64(g >> 8), float64(bl >> 8)})
+		}
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	centroids := seedCentroids(pixels, k)
+	assignments := make([]int, len(pixels))
+	counts := make([]int, len(centroids))
+
+	for iter := 0; iter < paletteIterations; iter++ {
+		changed := false
+		for i, p := range pixels {
+			best, bestDist := 0, math.MaxFloat64
+			for j, c := range centroids {
+				if d := p.dist(c); d < bestDist {
+					best, bestDist = j, d
+				}
+			}
+			if assignments[i] != best || iter == 0 {
+				changed = true
+			}
+			assignments[i] = best
+		}
+
+		sums := make([]paletteColor, len(centroids))
+		counts = make([]int, len(centroids))
+		for i, p := range pixels {
+			c := assignments[i]
+			sums[c][0] += p[0]
+			sums[c][1] += p[1]
+			sums[c][2] += p[2]
+			counts[c]++
+		}
+		for j := range centroids {
+			if counts[j] == 0 {
+				continue
+			}
+			n := float64(counts[j])
+			centroids[j] = paletteColor{sums[j][0] / n, sums[j][1] / n, sums[j][2] / n}
+		}
+
+		if !changed {
+			break
+		}
+	}
+
+	order := make([]int, len(centroids))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return counts[order[a]] > counts[order[b]]
+	})
+
+	palette := make([]string, 0, len(centroids))
+	for _, i := range order {
+		if counts[i] == 0 {
+			continue
+		}
+		palette = append(palette, centroids[i].hex())
+	}
+	return palette
+}
+
+// seedCentroids picks deterministic starting centroids using farthest-first traversal from the mean color
+func seedCentroids(pixels []paletteColor, k int) []paletteColor {
+	var mean paletteColor
+	for _, p := range pixels {
+		mean[0] += p[0]
+		mean[1] += p[1]
+		mean[2] += p[2]
+	}
+	n := float64(len(pixels))
+	mean = paletteColor{mean[0] / n, mean[1] / n, mean[2] / n}
+
+	centroids := []paletteColor{mean}
+	nearest := make([]float64, len(pixels))
+	for i, p := range pixels {
+		nearest[i] = p.dist(mean)
+	}
+
+	for len(centroids) < k {
+		far, farDist := -1, 0.0
+		for i, d := range nearest {
+			if d > farDist {
+				far, farDist = i, d
+			}
+		}
+		if far < 0 {
+			break //Fewer distinct colors than k
+		}
+
+		c := pixels[far]
+		centroids = append(centroids, c)
+		for i, p := range pixels {
+			if d := p.dist(c); d < nearest[i] {
+				nearest[i] = d
+			}
+		}
+	}
+
+	return centroids
+}
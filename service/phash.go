@@ -0,0 +1,58 @@
+package services
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+
+	"github.com/nfnt/resize"
+)
+
+const (
+	// phashBands is the number of 8 bit bands a hash is split into for indexing
+	phashBands = 8
+	// MaxSimilarDistance is the largest Hamming distance guaranteed to be found by the band index
+	MaxSimilarDistance = phashBands - 1
+	// DefaultSimilarDistance is used when no distance is requested
+	DefaultSimilarDistance = 5
+)
+
+// dHash computes a 64 bit difference hash, each bit records whether a pixel is brighter than its right neighbour
+// on a 9x8 grayscale reduction of the image
+func dHash(img image.Image) uint64 {
+	small := resize.Resize(9, 8, img, resize.Bilinear)
+
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			left := color.GrayModel.Convert(small.At(small.Bounds().Min.X+x, small.Bounds().Min.Y+y)).(color.Gray)
+			right := color.GrayModel.Convert(small.At(small.Bounds().Min.X+x+1, small.Bounds().Min.Y+y)).(color.Gray)
+			hash <<= 1
+			if left.Y > right.Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// hashBands splits a hash into its indexed bands, by the pigeonhole principle two hashes within
+// MaxSimilarDistance bits of each other share at least one band
+func hashBands(hash uint64) [phashBands]uint8 {
+	var bands [phashBands]uint8
+	for i := 0; i < phashBands; i++ {
+		bands[i] = uint8(hash >> (8 * i))
+	}
+	return bands
+}
+
+// uniformHash reports whether every bit of the hash is the same, as for flat images & smooth gradients.
+// They carry no detail so would match every other such image at distance 0
+func uniformHash(hash uint64) bool {
+	return hash == 0 || hash == math.MaxUint64
+}
+
+func hammingDistance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
@@ -0,0 +1,262 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+)
+
+func testGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+
+	anim := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, 40, 20), palette.Plan9)
+		for x := 0; x < 40; x++ {
+			for y := 0; y < 20; y++ {
+				frame.Set(x, y, color.RGBA{R: uint8(i * 60), G: 100, B: 200, A: 255})
+			}
+		}
+		anim.Image = append(anim.Image, frame)
+		anim.Delay = append(anim.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestGifFrameCount(t *testing.T) {
+	if n := gifFrameCount(testGIF(t, 3)); n != 3 {
+		t.Fatalf("expected 3 frames, got %v", n)
+	}
+	if n := gifFrameCount([]byte("not a gif")); n != 0 {
+		t.Fatalf("expected 0 frames, got %v", n)
+	}
+}
+
+// testPNGHeader returns a 1x1 PNG whose header declares the given dimensions
+func testPNGHeader(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	//Signature (8), IHDR length (4), type (4), then width & height, followed by the chunk CRC at 29
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestResizeService_DecodeLimits(t *testing.T) {
+	svc := ResizeService{maxPixels: 100_000, maxFrames: 5, maxGIFPixels: 40 * 20 * 4}
+
+	for name, data := range map[string][]byte{
+		"pixels":     testPNGHeader(t, 50000, 50000),
+		"svg pixels": []byte(`<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 100000 1"></svg>`),
+		"frames":     testGIF(t, 6),
+		"gif pixels": testGIF(t, 5),
+	} {
+		var out bytes.Buffer
+		if err := svc.Resize(context.Background(), data, &out, 10); !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: expected ErrImageTooLarge, got %v", name, err)
+		}
+		if err := svc.ResizeFrame(context.Background(), data, &out, 10, 0, ""); !errors.Is(err, ErrImageTooLarge) {
+			t.Errorf("%s: expected ErrImageTooLarge from ResizeFrame, got %v", name, err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := svc.Resize(context.Background(), testGIF(t, 4), &out, 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResizeService_ResizeVariants(t *testing.T) {
+	svc := ResizeService{}
+
+	src := image.NewRGBA(image.Rect(0, 0, 80, 40))
+	var png80 bytes.Buffer
+	if err := png.Encode(&png80, src); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"png": png80.Bytes(), "gif": testGIF(t, 3)} {
+		outs := map[int]*bytes.Buffer{10: {}, 20: {}}
+		writers := map[int]io.Writer{}
+		for size, buf := range outs {
+			writers[size] = buf
+		}
+		if err := svc.ResizeVariants(context.Background(), data, writers, ResizeOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		for size, buf := range outs {
+			cfg, _, err := image.DecodeConfig(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name == "gif" {
+				size /= 2
+			}
+			if cfg.Height != size || cfg.Width != size*2 {
+				t.Errorf("%s: expected %vx%v, got %vx%v", name, size*2, size, cfg.Width, cfg.Height)
+			}
+		}
+	}
+}
+
+func TestResizeService_ResizeFrame(t *testing.T) {
+	svc := ResizeService{}
+
+	var out bytes.Buffer
+	if err := svc.ResizeFrame(context.Background(), testGIF(t, 3), &out, 10, 1, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := jpeg.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Fatalf("unexpected size %vx%v", b.Dx(), b.Dy())
+	}
+	for _, format := range []string{"png", "webp"} {
+		var poster bytes.Buffer
+		if err := svc.ResizeFrame(context.Background(), testGIF(t, 3), &poster, 10, 1, format); err != nil {
+			t.Fatal(err)
+		}
+		if got := sniffImageType(poster.Bytes()); got != format {
+			t.Errorf("expected a %s poster, got %q", format, got)
+		}
+	}
+}
+
+func TestResizeService_BlurHash(t *testing.T) {
+	svc := ResizeService{}
+
+	var out bytes.Buffer
+	if err := svc.Resize(context.Background(), testGIF(t, 1), &out, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := svc.BlurHash(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hash) != 6+2*(4*3-1) {
+		t.Fatalf("unexpected hash %q", hash)
+	}
+}
+
+func TestExtractPalette(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 40, 40))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 40; y++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 30 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	palette := extractPalette(img, PaletteSize)
+	if len(palette) != 2 {
+		t.Fatalf("expected 2 colors, got %v", palette)
+	}
+	if palette[0] != "#ff0000" || palette[1] != "#0000ff" {
+		t.Fatalf("unexpected palette %v", palette)
+	}
+}
+
+func TestPerceptualHash(t *testing.T) {
+	svc := ResizeService{}
+
+	var small, large bytes.Buffer
+	src := testGIF(t, 1)
+	if err := svc.Resize(context.Background(), src, &small, 50); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.Resize(context.Background(), src, &large, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := svc.PerceptualHash(small.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := svc.PerceptualHash(large.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := hammingDistance(a, b); d > DefaultSimilarDistance {
+		t.Fatalf("resized copies too far apart: %v", d)
+	}
+
+	//Any hash within MaxSimilarDistance must share a band
+	flipped := a ^ 0x8040201008040201>>1
+	if hammingDistance(a, flipped) != MaxSimilarDistance {
+		t.Fatalf("unexpected distance %v", hammingDistance(a, flipped))
+	}
+	shared := false
+	ab, fb := hashBands(a), hashBands(flipped)
+	for i := range ab {
+		shared = shared || ab[i] == fb[i]
+	}
+	if !shared {
+		t.Fatal("expected a shared band")
+	}
+
+	//Flat images have no detail to match on
+	flat := image.NewGray(image.Rect(0, 0, 32, 32))
+	if h := dHash(flat); !uniformHash(h) {
+		t.Fatalf("expected a uniform hash for a flat image, got %016x", h)
+	}
+}
+
+func TestResizeService_ResizeFormats(t *testing.T) {
+	svc := ResizeService{}
+
+	var png80 bytes.Buffer
+	if err := png.Encode(&png80, image.NewRGBA(image.Rect(0, 0, 80, 40))); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"png": png80.Bytes(), "gif": testGIF(t, 3)} {
+		for _, format := range OutputFormats {
+			var out bytes.Buffer
+			if err := svc.ResizeVariants(context.Background(), data, map[int]io.Writer{20: &out}, ResizeOptions{Format: format}); err != nil {
+				t.Fatalf("%s as %s: %v", name, format, err)
+			}
+			if got := sniffImageType(out.Bytes()); got != format {
+				t.Errorf("%s as %s: encoded %q", name, format, got)
+			}
+		}
+	}
+
+	for requested, want := range map[string]string{"": "", "JPEG": "jpg", "webp": "webp", "gif": "gif"} {
+		if got, err := ParseOutputFormat(requested); err != nil || got != want {
+			t.Errorf("ParseOutputFormat(%q) = %q, %v", requested, got, err)
+		}
+	}
+	if _, err := ParseOutputFormat("svg"); !errors.Is(err, ErrInvalidImageFormat) {
+		t.Errorf("expected ErrInvalidImageFormat, got %v", err)
+	}
+}
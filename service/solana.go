@@ -1,7 +1,7 @@
 package services
 
 import (
-	ctx "context"
+	gocontext "context"
 	"errors"
 	nft_proxy "github.com/alphabatem/nft-proxy"
 	"github.com/alphabatem/nft-proxy/metaplex_core"
@@ -11,24 +11,37 @@ import (
 	bin "github.com/gagliardetto/binary"
 	"github.com/gagliardetto/solana-go"
 	"github.com/gagliardetto/solana-go/rpc"
-	"log"
-	"os"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sort"
 	"strings"
 )
 
 type SolanaService struct {
 	context.DefaultService
 	client *rpc.Client
+	logger *slog.Logger
 }
 
 const SOLANA_SVC = "solana_svc"
 
+// Offsets of fixed position fields within a legacy token metadata account, used for getProgramAccounts memcmp filters.
+// Name, symbol & uri are padded to their max length so the first creator is always at the same offset
+const (
+	METADATA_UPDATE_AUTHORITY_OFFSET = 1
+	METADATA_MINT_OFFSET             = 1 + 32
+	METADATA_FIRST_CREATOR_OFFSET    = 1 + 32 + 32 + (4 + 32) + (4 + 10) + (4 + 200) + 2 + 1 + 4
+)
+
 func (svc SolanaService) Id() string {
 	return SOLANA_SVC
 }
 
 func (svc *SolanaService) Start() error {
-	svc.client = rpc.New(os.Getenv("RPC_URL"))
+	cfg := svc.Service(CONFIG_SVC).(*ConfigService).Config
+	svc.client = rpc.New(cfg.RPC.URL)
+	svc.logger = Logger(LOG_SOLANA)
 
 	return nil
 }
@@ -38,7 +51,7 @@ func (svc *SolanaService) Client() *rpc.Client {
 }
 
 func (svc *SolanaService) RecentBlockhash() (solana.Hash, error) {
-	bhash, err := svc.Client().GetRecentBlockhash(ctx.Background(), rpc.CommitmentFinalized)
+	bhash, err := svc.Client().GetRecentBlockhash(gocontext.Background(), rpc.CommitmentFinalized)
 	if err != nil {
 		return solana.Hash{}, err
 	}
@@ -46,45 +59,91 @@ func (svc *SolanaService) RecentBlockhash() (solana.Hash, error) {
 	return bhash.Value.Blockhash, nil
 }
 
-func (svc *SolanaService) TokenData(key solana.PublicKey) (*token_metadata.Metadata, uint8, error) {
+// TokenInspection is everything resolved while looking up the metadata for a key
+type TokenInspection struct {
+	Key             solana.PublicKey
+	Owner           solana.PublicKey // Program owning the key account, zero if the account doesnt exist
+	Decimals        uint8
+	Extensions      []string // Token-2022 mint extensions
+	MetadataPointer *solana.PublicKey
+	LegacyPDA       solana.PublicKey
+	Token22PDA      solana.PublicKey
+	MetadataAccount solana.PublicKey // Account the metadata was decoded from
+	Metadata        *token_metadata.Metadata
+}
+
+func (svc *SolanaService) TokenData(ctx gocontext.Context, key solana.PublicKey) (_ *token_metadata.Metadata, _ uint8, err error) {
+	ctx, span := tracer.Start(ctx, "SolanaService.TokenData",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrMint.String(key.String()), attrRPCMethod.String("getMultipleAccounts")),
+	)
+	defer func() { endSpan(span, err) }()
+
+	ins, err := svc.Inspect(ctx, key)
+	if ins == nil {
+		return nil, 0, err
+	}
+	if ins.Metadata != nil {
+		span.SetAttributes(attribute.String("nft.protocol", ins.Metadata.Protocol.String()))
+	}
+	svc.logger.DebugContext(ctx, "Token data", "mint", key.String(), "owner", ins.Owner.String(), "account", ins.MetadataAccount.String(), "err", err)
+	return ins.Metadata, ins.Decimals, err
+}
+
+// Inspect resolves the metadata for a key across legacy, Token-2022 (in-mint & pointer) & Metaplex Core accounts
+func (svc *SolanaService) Inspect(ctx gocontext.Context, key solana.PublicKey) (*TokenInspection, error) {
 	var meta token_metadata.Metadata
 	var mint token_2022.Mint
 
 	ata, _, _ := svc.FindTokenMetadataAddress(key, solana.TokenMetadataProgramID)
 	ataT22, _, _ := svc.FindTokenMetadataAddress(key, solana.MustPublicKeyFromBase58("META4s4fSmpkTbZoUsgC1oBnWB31vQcmnN8giPw51Zu"))
 
-	accs, err := svc.client.GetMultipleAccountsWithOpts(ctx.TODO(), []solana.PublicKey{key, ata, ataT22}, &rpc.GetMultipleAccountsOpts{Commitment: rpc.CommitmentProcessed})
+	accs, err := svc.client.GetMultipleAccountsWithOpts(ctx, []solana.PublicKey{key, ata, ataT22}, &rpc.GetMultipleAccountsOpts{Commitment: rpc.CommitmentProcessed})
 	if err != nil {
-		return nil, 0, err
+		return nil, err
+	}
+
+	ins := &TokenInspection{
+		Key:        key,
+		LegacyPDA:  ata,
+		Token22PDA: ataT22,
 	}
 
-	var decimals uint8
 	if accs.Value[0] != nil {
 		//log.Printf("SolanaService::TokenData:%s - Owner: %s", key, accs.Value[0].Owner)
+		ins.Owner = accs.Value[0].Owner
 
 		err := mint.UnmarshalWithDecoder(bin.NewBinDecoder(accs.Value[0].Data.GetBinary()))
 		if err == nil {
-			decimals = mint.Decimals
+			ins.Decimals = mint.Decimals
 		}
 
 		switch accs.Value[0].Owner {
 		case nft_proxy.METAPLEX_CORE:
 			_meta, err := svc.decodeMetaplexCoreMetadata(key, accs.Value[0].Data.GetBinary())
 			if err != nil {
-				return nil, decimals, err
+				return ins, err
 			}
 
 			if _meta != nil {
-				return _meta, decimals, nil
+				ins.Metadata, ins.MetadataAccount = _meta, key
+				return ins, nil
 			}
 		case nft_proxy.TOKEN_2022:
+			tlv := token22Extensions(accs.Value[0].Data.GetBinary())
+			for t := range tlv {
+				ins.Extensions = append(ins.Extensions, token22ExtensionName(t))
+			}
+			sort.Strings(ins.Extensions)
+			ins.MetadataPointer = token22MetadataPointer(tlv)
+
 			exts, err := mint.Extensions()
 			if err != nil {
-				log.Printf("T22 Ext err: %s", err)
+				svc.logger.WarnContext(ctx, "Token-2022 extensions decode failed", "mint", key.String(), "err", err)
 				break
 			}
 			if exts != nil && exts.TokenMetadata != nil {
-				return &token_metadata.Metadata{
+				ins.Metadata = &token_metadata.Metadata{
 					Protocol:        token_metadata.PROTOCOL_TOKEN22_MINT,
 					UpdateAuthority: *exts.TokenMetadata.Authority,
 					Mint:            exts.TokenMetadata.Mint,
@@ -93,25 +152,62 @@ func (svc *SolanaService) TokenData(key solana.PublicKey) (*token_metadata.Metad
 						Symbol: exts.TokenMetadata.Symbol,
 						Uri:    exts.TokenMetadata.Uri,
 					},
-				}, decimals, nil
+				}
+				ins.MetadataAccount = key
+				return ins, nil
+			}
+
+			if ins.MetadataPointer != nil && !ins.MetadataPointer.Equals(key) {
+				_meta, err := svc.decodePointerMetadata(ctx, *ins.MetadataPointer)
+				if err != nil {
+					svc.logger.WarnContext(ctx, "Token-2022 metadata pointer decode failed", "mint", key.String(), "pointer", ins.MetadataPointer.String(), "err", err)
+					break
+				}
+				ins.Metadata, ins.MetadataAccount = _meta, *ins.MetadataPointer
+				return ins, nil
 			}
 		}
 	}
 
-	for _, acc := range accs.Value[1:] {
+	for i, acc := range accs.Value[1:] {
 		if acc == nil {
 			continue
 		}
 
 		err := bin.NewBorshDecoder(acc.Data.GetBinary()).Decode(&meta)
 		if err != nil {
-			log.Printf("Decode err: %s", err)
+			svc.logger.WarnContext(ctx, "Metadata decode failed", "mint", key.String(), "err", err)
 			continue
 		}
-		return &meta, decimals, nil
+		ins.Metadata = &meta
+		ins.MetadataAccount = []solana.PublicKey{ata, ataT22}[i]
+		return ins, nil
+	}
+
+	return ins, errors.New("unable to find token metadata")
+}
+
+// decodePointerMetadata decodes legacy metadata from the account a Token-2022 MetadataPointer references
+func (svc *SolanaService) decodePointerMetadata(ctx gocontext.Context, address solana.PublicKey) (_ *token_metadata.Metadata, err error) {
+	ctx, span := tracer.Start(ctx, "SolanaService.decodePointerMetadata",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("nft.metadata_pointer", address.String()), attrRPCMethod.String("getAccountInfo")),
+	)
+	defer func() { endSpan(span, err) }()
+
+	acc, err := svc.client.GetAccountInfoWithOpts(ctx, address, &rpc.GetAccountInfoOpts{Commitment: rpc.CommitmentProcessed})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil, decimals, errors.New("unable to find token metadata")
+	var meta token_metadata.Metadata
+	err = bin.NewBorshDecoder(acc.Value.Data.GetBinary()).Decode(&meta)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Protocol = token_metadata.PROTOCOL_TOKEN22_POINTER
+	return &meta, nil
 }
 
 func (svc *SolanaService) decodeMintMetadata(data []byte) (*token_metadata.Metadata, error) {
@@ -155,8 +251,6 @@ func (svc *SolanaService) decodeMetaplexCoreMetadata(mint solana.PublicKey, data
 		return nil, err
 	}
 
-	log.Printf("%+v\n", meta)
-
 	tMeta := token_metadata.Metadata{
 		Protocol: token_metadata.PROTOCOL_METAPLEX_CORE,
 		Mint:     mint,
@@ -173,10 +267,34 @@ func (svc *SolanaService) decodeMetaplexCoreMetadata(mint solana.PublicKey, data
 	return &tMeta, nil
 }
 
-func (svc *SolanaService) CreatorKeys(tokenMint solana.PublicKey) ([]solana.PublicKey, error) {
-	metadata, _, err := svc.TokenData(tokenMint)
+// FindMetadataAccounts returns all legacy token metadata accounts matching the memcmp filters
+func (svc *SolanaService) FindMetadataAccounts(ctx gocontext.Context, filters ...rpc.RPCFilter) ([]*token_metadata.Metadata, error) {
+	accs, err := svc.client.GetProgramAccountsWithOpts(ctx, solana.TokenMetadataProgramID, &rpc.GetProgramAccountsOpts{
+		Commitment: rpc.CommitmentConfirmed,
+		Filters:    filters,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]*token_metadata.Metadata, 0, len(accs))
+	for _, acc := range accs {
+		var meta token_metadata.Metadata
+		err := bin.NewBorshDecoder(acc.Account.Data.GetBinary()).Decode(&meta)
+		if err != nil {
+			svc.logger.WarnContext(ctx, "Metadata decode failed", "account", acc.Pubkey.String(), "err", err)
+			continue
+		}
+		out = append(out, &meta)
+	}
+
+	return out, nil
+}
+
+func (svc *SolanaService) CreatorKeys(ctx gocontext.Context, tokenMint solana.PublicKey) ([]solana.PublicKey, error) {
+	metadata, _, err := svc.TokenData(ctx, tokenMint)
 	if err != nil {
-		log.Printf("%s creatorKeys err: %s", tokenMint, err)
+		svc.logger.WarnContext(ctx, "Creator keys lookup failed", "mint", tokenMint.String(), "err", err)
 		return nil, err
 	}
 
@@ -1,48 +1,75 @@
 package services
 
 import (
+	gocontext "context"
 	"encoding/json"
-	"io"
-	"log"
-	"net/http"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
-	"time"
 
 	nft_proxy "github.com/alphabatem/nft-proxy"
 	token_metadata "github.com/alphabatem/nft-proxy/token-metadata"
 	"github.com/babilu-online/common/context"
 	"github.com/gagliardetto/solana-go"
-	"gorm.io/gorm/clause"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type SolanaImageService struct {
 	context.DefaultService
-	sql *SqliteService
-	sol *SolanaService
+	store *StorageService
+	sol   *SolanaService
 
-	http *http.Client
+	http   *SafeClient
+	logger *slog.Logger
 }
 
 const SOLANA_IMG_SVC = "solana_img_svc"
 
+// similarCandidateLimit caps the rows pulled from the band index for a single similarity lookup
+const similarCandidateLimit = 5000
+
+// metadataColumns are overwritten when metadata is refreshed, columns derived from the image itself are left alone
+// apart from the sniffed type, which SaveMedia resets when the image uri changes
+var metadataColumns = []string{
+	"mint_decimals",
+	"image_uri",
+	"image_type",
+	"media_uri",
+	"media_type",
+	"local_path",
+	"name",
+	"symbol",
+	"update_authority",
+	"collection",
+}
+
 func (svc SolanaImageService) Id() string {
 	return SOLANA_IMG_SVC
 }
 
 func (svc *SolanaImageService) Start() error {
-	svc.http = &http.Client{Timeout: 5 * time.Second}
+	cfg := svc.Service(CONFIG_SVC).(*ConfigService).Config
+	svc.http = NewSafeClient(cfg.Fetch, cfg.Image.MetadataTimeout.Duration())
+	svc.logger = Logger(LOG_SOLANA_IMG)
 
-	svc.sql = svc.Service(SQLITE_SVC).(*SqliteService)
+	svc.store = svc.Service(STORAGE_SVC).(*StorageService)
 	svc.sol = svc.Service(SOLANA_SVC).(*SolanaService)
 	return nil
 }
 
-func (svc *SolanaImageService) Media(key string, skipCache bool) (*nft_proxy.Media, error) {
-	var media *nft_proxy.SolanaMedia
-	err := svc.sql.Db().First(&media, "mint = ?", key).Error
+func (svc *SolanaImageService) Media(ctx gocontext.Context, key string, skipCache bool) (*nft_proxy.Media, error) {
+	_, span := tracer.Start(ctx, "StorageService.Media", trace.WithAttributes(attrMint.String(key), semconv.DBSystemKey.String(svc.store.Driver())))
+	media, err := svc.store.Media(key)
+	span.SetAttributes(attrCacheHit.Bool(err == nil))
+	span.End()
+
 	if err != nil || skipCache {
-		log.Printf("FetchMetadata - %s err: %s", key, err)
-		media, err = svc.FetchMetadata(key)
+		svc.logger.DebugContext(ctx, "Fetching metadata", "mint", key, "skip_cache", skipCache, "err", err)
+		media, err = svc.FetchMetadata(ctx, key)
 		if err != nil {
 			return nil, err //Still cant get metadata
 		}
@@ -51,12 +78,21 @@ func (svc *SolanaImageService) Media(key string, skipCache bool) (*nft_proxy.Med
 	return media.Media(), nil
 }
 
+// Store caches resolved metadata for the mint
+func (svc *SolanaImageService) Store(key string, metadata *nft_proxy.NFTMetadataSimple) (*nft_proxy.Media, error) {
+	media, err := svc.cache(key, metadata, "")
+	if err != nil {
+		return nil, err
+	}
+	return media.Media(), nil
+}
+
 func (svc *SolanaImageService) RemoveMedia(key string) error {
-	return svc.sql.Db().Delete(&nft_proxy.SolanaMedia{}, "mint = ?", key).Error
+	return svc.store.DeleteMedia(key)
 }
 
-func (svc *SolanaImageService) FetchMetadata(key string) (*nft_proxy.SolanaMedia, error) {
-	metadata, err := svc._retrieveMetadata(key)
+func (svc *SolanaImageService) FetchMetadata(ctx gocontext.Context, key string) (*nft_proxy.SolanaMedia, error) {
+	metadata, err := svc._retrieveMetadata(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -69,19 +105,29 @@ func (svc *SolanaImageService) FetchMetadata(key string) (*nft_proxy.SolanaMedia
 	return media, nil
 }
 
-func (svc *SolanaImageService) _retrieveMetadata(key string) (*nft_proxy.NFTMetadataSimple, error) {
+func (svc *SolanaImageService) _retrieveMetadata(ctx gocontext.Context, key string) (*nft_proxy.NFTMetadataSimple, error) {
 	pk, err := solana.PublicKeyFromBase58(key)
 	if err != nil {
 		return nil, err
 	}
-	tokenData, decimals, err := svc.sol.TokenData(pk)
+	tokenData, decimals, err := svc.sol.TokenData(ctx, pk)
 	if err != nil || tokenData == nil {
-		log.Printf("No token data for %s - %s", pk, err)
+		svc.logger.WarnContext(ctx, "No token data", "mint", key, "err", err)
 		return nil, err
 	}
 
 	//log.Printf("TokenData retreive (%v): %+v\n", decimals, tokenData)
 
+	return svc.MetadataFromToken(ctx, tokenData, decimals)
+}
+
+// MetadataFromToken resolves the off-chain metadata for decoded on-chain token data where available
+func (svc *SolanaImageService) MetadataFromToken(ctx gocontext.Context, tokenData *token_metadata.Metadata, decimals uint8) (*nft_proxy.NFTMetadataSimple, error) {
+	collection := ""
+	if tokenData.Collection != nil && tokenData.Collection.Verified {
+		collection = tokenData.Collection.Key.String()
+	}
+
 	switch tokenData.Protocol {
 	case token_metadata.PROTOCOL_METAPLEX_CORE:
 		return &nft_proxy.NFTMetadataSimple{
@@ -90,16 +136,22 @@ func (svc *SolanaImageService) _retrieveMetadata(key string) (*nft_proxy.NFTMeta
 			Name:            strings.Trim(tokenData.Data.Name, "\x00"),
 			Symbol:          strings.Trim(tokenData.Data.Symbol, "\x00"),
 			UpdateAuthority: tokenData.UpdateAuthority.String(),
+			CollectionKey:   collection,
 		}, nil
 	default:
 		//Get file meta if possible
-		f, err := svc.retrieveFile(tokenData.Data.Uri)
+		f, err := svc.retrieveFile(ctx, tokenData.Data.Uri)
 		if f != nil {
 			f.Decimals = decimals
 			f.UpdateAuthority = tokenData.UpdateAuthority.String()
+			f.CollectionKey = collection
 			return f, nil
 		}
-		log.Printf("(%s) retrieveFile err: %s", tokenData.Data.Uri, err)
+		if IsFetchViolation(err) {
+			svc.RecordViolation(ctx, tokenData.Mint.String(), nft_proxy.ViolationStageFetch, tokenData.Data.Uri, err)
+		} else {
+			svc.logger.WarnContext(ctx, "Off-chain metadata fetch failed", "mint", tokenData.Mint.String(), "uri", strings.Trim(tokenData.Data.Uri, "\x00"), "err", err)
+		}
 	}
 
 	//No Metadata
@@ -108,21 +160,23 @@ func (svc *SolanaImageService) _retrieveMetadata(key string) (*nft_proxy.NFTMeta
 		Decimals:        decimals,
 		Symbol:          strings.Trim(tokenData.Data.Symbol, "\x00"),
 		UpdateAuthority: tokenData.UpdateAuthority.String(),
+		CollectionKey:   collection,
 	}, nil
 }
 
-func (svc *SolanaImageService) retrieveFile(uri string) (*nft_proxy.NFTMetadataSimple, error) {
-	file, err := svc.http.Get(strings.Trim(uri, "\x00")) //Strip crap off urls
-	if err != nil {
-		return nil, err
-	}
+func (svc *SolanaImageService) retrieveFile(ctx gocontext.Context, uri string) (_ *nft_proxy.NFTMetadataSimple, err error) {
+	ctx, span := tracer.Start(ctx, "SolanaImageService.retrieveFile", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
 
-	if file.StatusCode != 200 {
-		return nil, err
+	uri = strings.Trim(uri, "\x00") //Strip crap off urls
+	if u, err := url.Parse(uri); err == nil {
+		span.SetAttributes(semconv.ServerAddress(u.Host))
 	}
 
-	defer file.Body.Close()
-	data, err := io.ReadAll(file.Body)
+	data, resp, err := svc.http.Get(ctx, uri, contentMetadata)
+	if resp != nil {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -137,6 +191,13 @@ func (svc *SolanaImageService) retrieveFile(uri string) (*nft_proxy.NFTMetadataS
 }
 
 func (svc *SolanaImageService) cache(key string, metadata *nft_proxy.NFTMetadataSimple, localPath string) (*nft_proxy.SolanaMedia, error) {
+	media := svc.MediaFromMetadata(key, metadata, localPath)
+
+	return media, svc.store.SaveMedia(metadataColumns, media)
+}
+
+// MediaFromMetadata builds the row that would be cached for the metadata without storing it
+func (svc *SolanaImageService) MediaFromMetadata(key string, metadata *nft_proxy.NFTMetadataSimple, localPath string) *nft_proxy.SolanaMedia {
 	media := nft_proxy.SolanaMedia{
 		Mint:      key,
 		LocalPath: localPath,
@@ -149,6 +210,7 @@ func (svc *SolanaImageService) cache(key string, metadata *nft_proxy.NFTMetadata
 		media.ImageUri = metadata.Image
 		media.ImageType = svc.guessImageType(metadata)
 		media.UpdateAuthority = metadata.UpdateAuthority
+		media.Collection = metadata.CollectionKey
 		media.MintDecimals = metadata.Decimals
 
 		mediaFile := metadata.AnimationFile()
@@ -161,10 +223,85 @@ func (svc *SolanaImageService) cache(key string, metadata *nft_proxy.NFTMetadata
 		}
 	}
 
-	return &media, svc.sql.Db().Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "mint"}}, // key colum
-		UpdateAll: true,
-	}).Create(&media).Error
+	return &media
+}
+
+// maxViolationUrl is the longest URL stored with a violation
+const maxViolationUrl = 512
+
+// RecordViolation logs & stores why media for the mint was refused
+func (svc *SolanaImageService) RecordViolation(ctx gocontext.Context, mint string, stage nft_proxy.ViolationStage, uri string, reason error) {
+	uri = strings.Trim(uri, "\x00")
+	if len(uri) > maxViolationUrl { //Inline data URIs carry the whole image
+		uri = uri[:maxViolationUrl]
+	}
+	svc.logger.WarnContext(ctx, "Media violation", "mint", mint, "stage", stage, "url", uri, "reason", reason)
+
+	err := svc.store.SaveViolation(&nft_proxy.MediaViolation{Mint: mint, Stage: stage, Url: uri, Reason: reason.Error()})
+	if err != nil {
+		svc.logger.ErrorContext(ctx, "Saving media violation failed", "mint", mint, "err", err)
+	}
+}
+
+// Violations returns the most recent media violations, for a single mint when given
+func (svc *SolanaImageService) Violations(mint string, limit int) ([]*nft_proxy.MediaViolation, error) {
+	return svc.store.Violations(mint, limit)
+}
+
+// SetImageProperties stores properties derived from the downloaded image for the mint
+func (svc *SolanaImageService) SetImageProperties(key string, props map[string]interface{}) error {
+	return svc.store.UpdateMedia(key, props)
+}
+
+// IndexHash stores the perceptual hash for the mint & replaces its band index entries
+func (svc *SolanaImageService) IndexHash(key string, hash uint64) error {
+	if uniformHash(hash) {
+		return svc.store.IndexHash(key, fmt.Sprintf("%016x", hash), nil) //Stored so it isnt recomputed, but never a candidate
+	}
+	bands := hashBands(hash)
+	return svc.store.IndexHash(key, fmt.Sprintf("%016x", hash), bands[:])
+}
+
+// SimilarMedia returns other mints whose perceptual hash is within maxDistance bits of the hash, closest first.
+// Candidates are found through the band index & then filtered on their exact Hamming distance
+func (svc *SolanaImageService) SimilarMedia(key string, hash uint64, maxDistance int) ([]*nft_proxy.SimilarMedia, error) {
+	similar := make([]*nft_proxy.SimilarMedia, 0)
+	if uniformHash(hash) {
+		return similar, nil
+	}
+
+	bands := hashBands(hash)
+	candidates, err := svc.store.HashCandidates(key, bands[:], similarCandidateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range candidates {
+		cHash, err := strconv.ParseUint(c.PHash, 16, 64)
+		if err != nil || uniformHash(cHash) {
+			continue
+		}
+
+		distance := hammingDistance(hash, cHash)
+		if distance > maxDistance {
+			continue
+		}
+
+		similar = append(similar, &nft_proxy.SimilarMedia{
+			Mint:            c.Mint,
+			Name:            c.Name,
+			UpdateAuthority: c.UpdateAuthority,
+			BlurHash:        c.BlurHash,
+			PHash:           c.PHash,
+			Distance:        distance,
+		})
+	}
+
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+
+	return similar, nil
 }
 
 func (svc *SolanaImageService) guessImageType(metadata *nft_proxy.NFTMetadataSimple) string {
@@ -172,6 +309,10 @@ func (svc *SolanaImageService) guessImageType(metadata *nft_proxy.NFTMetadataSim
 		return "jpg"
 	}
 
+	if strings.HasPrefix(metadata.Image, "data:image/svg+xml") {
+		return "svg"
+	}
+
 	imageType := ""
 	imgFile := metadata.ImageFile()
 	if imgFile != nil && strings.Contains(imgFile.Type, "/") {
@@ -191,9 +332,10 @@ func (svc *SolanaImageService) guessImageType(metadata *nft_proxy.NFTMetadataSim
 	if strings.Contains(imageType, "?") {
 		imageType = strings.Split(imageType, "?")[0]
 	}
+	imageType = strings.TrimSuffix(imageType, "+xml") //image/svg+xml
 
 	if !svc.ValidType(imageType) {
-		log.Printf("Invalid image type guessed: %s", imageType)
+		svc.logger.Debug("Invalid image type guessed, using jpg", "type", imageType)
 		return "jpg"
 	}
 
@@ -1,9 +1,12 @@
 package services
 
 import (
+	"context"
+	svccontext "github.com/babilu-online/common/context"
 	"github.com/gagliardetto/solana-go"
 	"github.com/joho/godotenv"
 	"log"
+	"os"
 	"testing"
 )
 
@@ -18,10 +21,21 @@ func TestSolanaImageService_FetchMetadata(t *testing.T) {
 
 	pk := solana.MustPublicKeyFromBase58("CJ9AXYbSUPoR95oMvWzgCV3GbG3ZubQjFUpRHN7xqAVb")
 
-	svc := SolanaService{}
-	svc.Start()
+	cfg := DefaultConfig()
+	if url := os.Getenv("RPC_URL"); url != "" {
+		cfg.RPC.URL = url
+	}
+
+	ctx, err := svccontext.NewCtx(&ConfigService{Config: cfg}, &SolanaService{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Run(); err != nil {
+		t.Fatal(err)
+	}
+	svc := ctx.Service(SOLANA_SVC).(*SolanaService)
 
-	d, _, err := svc.TokenData(pk)
+	d, _, err := svc.TokenData(context.Background(), pk)
 	if err != nil {
 		t.Fatal(err)
 	}
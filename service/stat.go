@@ -3,7 +3,6 @@ package services
 import (
 	"sync/atomic"
 
-	nft_proxy "github.com/alphabatem/nft-proxy"
 	"github.com/babilu-online/common/context"
 )
 
@@ -14,7 +13,8 @@ type StatService struct {
 	mediaFilesServed uint64
 	requestsServed   uint64
 
-	sql *SqliteService
+	store *StorageService
+	cache *CacheService
 }
 
 const STAT_SVC = "stat_svc"
@@ -24,7 +24,8 @@ func (svc StatService) Id() string {
 }
 
 func (svc *StatService) Start() error {
-	svc.sql = svc.Service(SQLITE_SVC).(*SqliteService)
+	svc.store = svc.Service(STORAGE_SVC).(*StorageService)
+	svc.cache = svc.Service(CACHE_SVC).(*CacheService)
 
 	return nil
 }
@@ -42,13 +43,19 @@ func (svc *StatService) IncrementMediaRequests() {
 }
 
 func (svc *StatService) ServiceStats() (map[string]interface{}, error) {
-	var imgCount int64
-	svc.sql.Db().Model(&nft_proxy.SolanaMedia{}).Count(&imgCount)
+	imgCount, err := svc.store.CountMedia()
+	if err != nil {
+		return nil, err
+	}
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"imagesStored":     imgCount,
 		"requestsServed":   svc.requestsServed,
 		"imageFilesServed": svc.imageFilesServed,
 		"mediaFilesServed": svc.mediaFilesServed,
-	}, nil
+	}
+	for k, v := range svc.cache.Stats() {
+		stats[k] = v
+	}
+	return stats, nil
 }
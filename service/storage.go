@@ -0,0 +1,413 @@
+package services
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	nft_proxy "github.com/alphabatem/nft-proxy"
+	"github.com/babilu-online/common/context"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Storage is the persistence used by the services & CLIs, implemented for SQLite & Postgres
+type Storage interface {
+	Open() error
+	Close() error
+	Ping(ctx gocontext.Context) error
+
+	MigrationStatus() ([]*MigrationState, error)
+	SchemaVersion() (int, error)
+	MigrateUp(target int) error
+	MigrateDown(target int) error
+
+	Media(mint string) (*nft_proxy.SolanaMedia, error)
+	SaveMedia(columns []string, media ...*nft_proxy.SolanaMedia) error
+	UpdateMedia(mint string, props map[string]interface{}) error
+	DeleteMedia(mints ...string) error
+	ExistingMints(mints []string) ([]string, error)
+	CountMedia() (int64, error)
+	EachMedia(filter MediaFilter, batchSize int, fn func(batch []*nft_proxy.SolanaMedia) error) error
+
+	IndexHash(mint string, pHash string, bands []uint8) error
+	HashCandidates(mint string, bands []uint8, limit int) ([]*nft_proxy.SolanaMedia, error)
+
+	BlockedMedia() ([]*nft_proxy.BlockedMedia, error)
+	SaveBlocked(entry *nft_proxy.BlockedMedia) error
+	DeleteBlocked(kind nft_proxy.BlockKind, key string) error
+
+	SaveViolation(v *nft_proxy.MediaViolation) error
+	Violations(mint string, limit int) ([]*nft_proxy.MediaViolation, error)
+}
+
+// MediaFilter narrows the rows visited by EachMedia, zero values match everything
+type MediaFilter struct {
+	UpdateAuthorities   []string
+	Since               time.Time
+	Until               time.Time
+	MissingDetectedType bool
+	MissingBlurHash     bool
+}
+
+const (
+	DB_DRIVER_SQLITE   = "sqlite"
+	DB_DRIVER_POSTGRES = "postgres"
+)
+
+// StorageService opens the Storage selected by db.driver & applies pending migrations,
+// with db.migrate=manual it instead refuses to start until `migrate up` has been run
+type StorageService struct {
+	context.DefaultService
+	Storage
+
+	driver        string
+	manualMigrate bool
+}
+
+const STORAGE_SVC = "storage_svc"
+
+// Id returns Service ID
+func (svc *StorageService) Id() string {
+	return STORAGE_SVC
+}
+
+// Driver returns the configured storage driver
+func (svc *StorageService) Driver() string {
+	return svc.driver
+}
+
+// Start opens the connection to the database & migrates it to the latest schema
+func (svc *StorageService) Start() error {
+	cfg := svc.Service(CONFIG_SVC).(*ConfigService).Config.DB
+	svc.driver = cfg.Driver
+	svc.manualMigrate = cfg.Migrate == "manual"
+
+	var err error
+	svc.Storage, err = StorageFromConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = svc.Open()
+	if err != nil {
+		return err
+	}
+
+	if !svc.manualMigrate {
+		return svc.MigrateUp(0)
+	}
+
+	version, err := svc.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version != LatestMigration() {
+		return fmt.Errorf("database schema is at version %v but %v is required, run the migrate up command", version, LatestMigration())
+	}
+	return nil
+}
+
+// StorageFromConfig returns the unopened storage for the configured driver
+func StorageFromConfig(cfg DBConfig) (Storage, error) {
+	switch cfg.Driver {
+	case DB_DRIVER_SQLITE:
+		return NewSqliteStorage(cfg.Database), nil
+	case DB_DRIVER_POSTGRES:
+		if cfg.DSN == "" {
+			return nil, errors.New("db.dsn is required for postgres")
+		}
+		return NewPostgresStorage(cfg.DSN), nil
+	}
+	return nil, fmt.Errorf("unknown db driver: %s", cfg.Driver)
+}
+
+// Shutdown Gracefully close the database connection
+func (svc *StorageService) Shutdown() {
+	if svc.Storage == nil {
+		return
+	}
+	if err := svc.Close(); err != nil {
+		Logger(LOG_STORAGE).Error("Closing storage failed", "err", err)
+	}
+}
+
+// DBError represents a database error with HTTP status code
+type DBError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *DBError) Error() string {
+	return fmt.Sprintf("database error (status %d): %v", e.StatusCode, e.Err)
+}
+
+func (e *DBError) Unwrap() error {
+	return e.Err
+}
+
+// gormStorage implements Storage on top of a gorm connection, the dialect specific types only open it
+type gormStorage struct {
+	db *gorm.DB
+}
+
+// Db Access to the raw gorm db
+func (s *gormStorage) Db() *gorm.DB {
+	return s.db
+}
+
+// Close the database connection
+func (s *gormStorage) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// Ping checks the database answers a statement. Its a plain read outside any transaction, as SQLite transactions take
+// the write lock (see sqliteDSN) & a probe shouldnt wait on or hold up writers
+func (s *gormStorage) Ping(ctx gocontext.Context) error {
+	if s.db == nil {
+		return errors.New("database not open")
+	}
+	return s.db.WithContext(ctx).Exec("SELECT 1").Error
+}
+
+func (s *gormStorage) Media(mint string) (*nft_proxy.SolanaMedia, error) {
+	var media nft_proxy.SolanaMedia
+	err := s.db.First(&media, "mint = ?", mint).Error
+	if err != nil {
+		return nil, s.error(err)
+	}
+	return &media, nil
+}
+
+// sniffedColumns are detected from the image bytes, so are reset when an upsert changes the image uri
+var sniffedColumns = []struct {
+	name string
+	zero interface{}
+}{
+	{"detected_type", ""},
+	{"animated", false},
+}
+
+// SaveMedia upserts the rows by mint, only the columns given are overwritten on conflict (all when nil).
+// Overwriting image_uri with a different uri also resets the sniffed columns
+func (s *gormStorage) SaveMedia(columns []string, media ...*nft_proxy.SolanaMedia) error {
+	if len(media) == 0 {
+		return nil
+	}
+
+	onConflict := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "mint"}},
+		UpdateAll: columns == nil,
+	}
+	if columns != nil {
+		onConflict.DoUpdates = clause.AssignmentColumns(columns)
+		if slices.Contains(columns, "image_uri") {
+			for _, c := range sniffedColumns {
+				onConflict.DoUpdates = append(onConflict.DoUpdates, clause.Assignment{
+					Column: clause.Column{Name: c.name},
+					Value:  gorm.Expr(fmt.Sprintf("CASE WHEN solana_media.image_uri = excluded.image_uri THEN solana_media.%s ELSE ? END", c.name), c.zero),
+				})
+			}
+		}
+	}
+
+	return s.error(s.db.Clauses(onConflict).Create(&media).Error)
+}
+
+// UpdateMedia sets the given columns on the mint's row
+func (s *gormStorage) UpdateMedia(mint string, props map[string]interface{}) error {
+	return s.error(s.db.Model(&nft_proxy.SolanaMedia{}).Where("mint = ?", mint).Updates(props).Error)
+}
+
+func (s *gormStorage) DeleteMedia(mints ...string) error {
+	if len(mints) == 0 {
+		return nil
+	}
+	return s.error(s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Delete(&nft_proxy.MediaHashBand{}, "mint IN ?", mints).Error
+		if err != nil {
+			return err
+		}
+		return tx.Delete(&nft_proxy.SolanaMedia{}, "mint IN ?", mints).Error
+	}))
+}
+
+// ExistingMints returns which of the mints have a row
+func (s *gormStorage) ExistingMints(mints []string) ([]string, error) {
+	var existing []string
+	err := s.db.Model(&nft_proxy.SolanaMedia{}).Where("mint IN ?", mints).Pluck("mint", &existing).Error
+	return existing, s.error(err)
+}
+
+func (s *gormStorage) CountMedia() (int64, error) {
+	var count int64
+	err := s.db.Model(&nft_proxy.SolanaMedia{}).Count(&count).Error
+	return count, s.error(err)
+}
+
+// EachMedia calls fn with batches of the rows matching the filter in insertion order
+func (s *gormStorage) EachMedia(filter MediaFilter, batchSize int, fn func(batch []*nft_proxy.SolanaMedia) error) error {
+	q := s.db.Model(&nft_proxy.SolanaMedia{})
+	if len(filter.UpdateAuthorities) > 0 {
+		q = q.Where("update_authority IN ?", filter.UpdateAuthorities)
+	}
+	if !filter.Since.IsZero() {
+		q = q.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		q = q.Where("created_at < ?", filter.Until)
+	}
+	if filter.MissingDetectedType {
+		q = q.Where("detected_type = ?", "")
+	}
+	if filter.MissingBlurHash {
+		q = q.Where("blur_hash = ?", "")
+	}
+
+	var rows []*nft_proxy.SolanaMedia
+	return q.FindInBatches(&rows, batchSize, func(tx *gorm.DB, batch int) error {
+		return fn(rows)
+	}).Error
+}
+
+// IndexHash stores the perceptual hash for the mint & replaces its band index entries, no bands leaves it unindexed
+func (s *gormStorage) IndexHash(mint string, pHash string, bands []uint8) error {
+	rows := make([]nft_proxy.MediaHashBand, len(bands))
+	for i, v := range bands {
+		rows[i] = nft_proxy.MediaHashBand{Mint: mint, Band: uint8(i), Value: v}
+	}
+
+	return s.error(s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&nft_proxy.SolanaMedia{}).Where("mint = ?", mint).Update("p_hash", pHash).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Delete(&nft_proxy.MediaHashBand{}, "mint = ?", mint).Error
+		if err != nil || len(rows) == 0 {
+			return err
+		}
+
+		return tx.Create(&rows).Error
+	}))
+}
+
+// HashCandidates returns up to limit other mints sharing at least one hash band
+func (s *gormStorage) HashCandidates(mint string, bands []uint8, limit int) ([]*nft_proxy.SolanaMedia, error) {
+	if len(bands) == 0 {
+		return nil, nil
+	}
+
+	bandMatch := s.db.Where("band = ? AND value = ?", 0, bands[0])
+	for i := 1; i < len(bands); i++ {
+		bandMatch = bandMatch.Or("band = ? AND value = ?", i, bands[i])
+	}
+
+	candidateMints := s.db.Model(&nft_proxy.MediaHashBand{}).
+		Distinct("mint").
+		Where("mint <> ?", mint).
+		Where(bandMatch).
+		Limit(limit)
+
+	var candidates []*nft_proxy.SolanaMedia
+	err := s.db.
+		Select("mint", "name", "update_authority", "blur_hash", "p_hash").
+		Where("mint IN (?)", candidateMints).
+		Find(&candidates).Error
+	return candidates, s.error(err)
+}
+
+// BlockedMedia returns all blocklist entries, newest first
+func (s *gormStorage) BlockedMedia() ([]*nft_proxy.BlockedMedia, error) {
+	var entries []*nft_proxy.BlockedMedia
+	err := s.db.Order("created_at desc").Find(&entries).Error
+	return entries, s.error(err)
+}
+
+// SaveBlocked upserts the entry, updating the reason if its already blocked
+func (s *gormStorage) SaveBlocked(entry *nft_proxy.BlockedMedia) error {
+	return s.error(s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "kind"}, {Name: "key"}},
+		DoUpdates: clause.AssignmentColumns([]string{"reason"}),
+	}).Create(entry).Error)
+}
+
+func (s *gormStorage) DeleteBlocked(kind nft_proxy.BlockKind, key string) error {
+	return s.error(s.db.Delete(&nft_proxy.BlockedMedia{}, "kind = ? AND key = ?", kind, key).Error)
+}
+
+// SaveViolation records the violation against the mint & stage, replacing the previous reason & bumping the count
+func (s *gormStorage) SaveViolation(v *nft_proxy.MediaViolation) error {
+	if v.Count == 0 {
+		v.Count = 1
+	}
+	return s.error(s.db.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "mint"}, {Name: "stage"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "url"}, Value: v.Url},
+			{Column: clause.Column{Name: "reason"}, Value: v.Reason},
+			{Column: clause.Column{Name: "count"}, Value: gorm.Expr("media_violations.count + 1")},
+			{Column: clause.Column{Name: "updated_at"}, Value: time.Now()},
+		},
+	}).Create(v).Error)
+}
+
+// Violations returns the most recently updated violations, for a single mint when given
+func (s *gormStorage) Violations(mint string, limit int) ([]*nft_proxy.MediaViolation, error) {
+	q := s.db.Order("updated_at desc").Limit(limit)
+	if mint != "" {
+		q = q.Where("mint = ?", mint)
+	}
+
+	var out []*nft_proxy.MediaViolation
+	err := q.Find(&out).Error
+	return out, s.error(err)
+}
+
+// configurePool applies the connection pool settings shared by each dialect
+func (s *gormStorage) configurePool(maxOpen int) error {
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database instance: %w", err)
+	}
+
+	sqlDB.SetMaxIdleConns(10)
+	sqlDB.SetMaxOpenConns(maxOpen)
+	sqlDB.SetConnMaxLifetime(time.Hour)
+	return nil
+}
+
+// Parse an error returned from the database into a more contextual error that can be used with http response codes
+func (s *gormStorage) error(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var statusCode int
+
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		statusCode = 404
+	case errors.Is(err, context.DeadlineExceeded):
+		statusCode = 504
+	default:
+		statusCode = 500
+	}
+
+	if statusCode != 404 {
+		Logger(LOG_STORAGE).Error("Database error", "status", statusCode, "err", err)
+	}
+	return &DBError{
+		StatusCode: statusCode,
+		Err:        err,
+	}
+}
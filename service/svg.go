@@ -0,0 +1,176 @@
+package services
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// svgBlockedElements are dropped from sanitized SVGs along with all of their children
+var svgBlockedElements = map[string]struct{}{
+	"script":        {},
+	"foreignobject": {},
+	"iframe":        {},
+	"embed":         {},
+	"object":        {},
+	"audio":         {},
+	"video":         {},
+}
+
+// isSVG reports whether the data looks like an SVG document
+func isSVG(data []byte) bool {
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	head = bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")))
+	if !bytes.HasPrefix(head, []byte("<")) {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(head), []byte("<svg"))
+}
+
+// sanitizeSVG strips scripts, event handlers & any external references from an SVG document
+// so it can be served directly to clients as image/svg+xml
+func sanitizeSVG(data []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.Entity = xml.HTMLEntity
+
+	var out bytes.Buffer
+	skipDepth := 0
+	inStyle := false
+	var style bytes.Buffer
+	sawRoot := false
+
+	for {
+		tok, err := dec.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid svg: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := strings.ToLower(t.Name.Local)
+			if skipDepth > 0 {
+				skipDepth++
+				continue
+			}
+			if _, blocked := svgBlockedElements[name]; blocked {
+				skipDepth = 1
+				continue
+			}
+			if !sawRoot {
+				if name != "svg" {
+					return nil, errors.New("invalid svg: root element is not svg")
+				}
+				sawRoot = true
+			}
+			if name == "style" {
+				inStyle = true
+				style.Reset()
+			}
+			writeSVGStart(&out, t)
+		case xml.EndElement:
+			if skipDepth > 0 {
+				skipDepth--
+				continue
+			}
+			if inStyle && strings.ToLower(t.Name.Local) == "style" {
+				inStyle = false
+				if safeSVGValue(style.String()) {
+					xml.EscapeText(&out, style.Bytes())
+				}
+			}
+			out.WriteString("</" + svgName(t.Name) + ">")
+		case xml.CharData:
+			if skipDepth > 0 {
+				continue
+			}
+			if inStyle {
+				style.Write(t)
+				continue
+			}
+			xml.EscapeText(&out, t)
+		case xml.ProcInst:
+			if t.Target == "xml" && out.Len() == 0 {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+		//Comments & directives (DOCTYPE/ENTITY) are dropped
+	}
+
+	if !sawRoot {
+		return nil, errors.New("invalid svg: no svg element")
+	}
+
+	return out.Bytes(), nil
+}
+
+func writeSVGStart(out *bytes.Buffer, t xml.StartElement) {
+	out.WriteString("<" + svgName(t.Name))
+	for _, attr := range t.Attr {
+		if !safeSVGAttr(attr) {
+			continue
+		}
+		out.WriteString(" " + svgName(attr.Name) + `="`)
+		xml.EscapeText(out, []byte(attr.Value))
+		out.WriteString(`"`)
+	}
+	out.WriteString(">")
+}
+
+func svgName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
+
+// safeSVGAttr rejects event handlers & references that would cause the client to load external content
+func safeSVGAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	if strings.HasPrefix(name, "on") {
+		return false
+	}
+
+	if name == "href" || name == "src" {
+		v := strings.TrimSpace(strings.ToLower(attr.Value))
+		if strings.HasPrefix(v, "#") {
+			return true
+		}
+		for _, prefix := range []string{"data:image/png", "data:image/jpeg", "data:image/jpg", "data:image/gif", "data:image/webp"} {
+			if strings.HasPrefix(v, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return safeSVGValue(attr.Value)
+}
+
+// safeSVGValue checks inline values & stylesheets for scripts or external url() references
+func safeSVGValue(v string) bool {
+	v = strings.ToLower(v)
+	if strings.Contains(v, "javascript:") || strings.Contains(v, "@import") || strings.Contains(v, "expression(") {
+		return false
+	}
+
+	for {
+		i := strings.Index(v, "url(")
+		if i < 0 {
+			return true
+		}
+		v = strings.TrimLeft(v[i+len("url("):], " '\"")
+		if !strings.HasPrefix(v, "#") && !strings.HasPrefix(v, "data:image/") {
+			return false
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+const testSVG = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE svg [<!ENTITY x "boom">]>
+<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" viewBox="0 0 200 100" onload="alert(1)">
+	<script>alert(document.cookie)</script>
+	<style>@import url(https://evil.example/x.css);</style>
+	<rect width="200" height="100" fill="#ff0000" style="fill:url(#grad)"/>
+	<image xlink:href="https://evil.example/track.png" width="10" height="10"/>
+	<use xlink:href="#shape"/>
+	<foreignObject><div>hi</div></foreignObject>
+	<a href="javascript:alert(1)"><circle cx="50" cy="50" r="40" fill="blue"/></a>
+</svg>`
+
+func TestSanitizeSVG(t *testing.T) {
+	if !isSVG([]byte(testSVG)) {
+		t.Fatal("expected svg to be detected")
+	}
+
+	out, err := sanitizeSVG([]byte(testSVG))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clean := string(out)
+	for _, bad := range []string{"<script", "onload", "@import", "evil.example", "foreignObject", "javascript:", "ENTITY"} {
+		if strings.Contains(clean, bad) {
+			t.Errorf("sanitized svg still contains %q: %s", bad, clean)
+		}
+	}
+	for _, good := range []string{`xlink:href="#shape"`, `<rect`, `<circle`, `viewBox="0 0 200 100"`} {
+		if !strings.Contains(clean, good) {
+			t.Errorf("sanitized svg missing %q: %s", good, clean)
+		}
+	}
+}
+
+func TestResizeService_SVG(t *testing.T) {
+	svc := ResizeService{}
+
+	var out bytes.Buffer
+	if err := svc.Resize(context.Background(), []byte(testSVG), &out, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 200 || b.Dy() != 100 {
+		t.Fatalf("unexpected size %vx%v", b.Dx(), b.Dy())
+	}
+}
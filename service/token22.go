@@ -0,0 +1,86 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gagliardetto/solana-go"
+)
+
+const (
+	// Token-2022 mints are padded to the size of a token account before the account type & extension TLVs
+	token22AccountTypeOffset = 165
+	token22AccountTypeMint   = 1
+
+	token22ExtMetadataPointer = 18
+)
+
+var token22ExtensionNames = []string{
+	"Uninitialized",
+	"TransferFeeConfig",
+	"TransferFeeAmount",
+	"MintCloseAuthority",
+	"ConfidentialTransferMint",
+	"ConfidentialTransferAccount",
+	"DefaultAccountState",
+	"ImmutableOwner",
+	"MemoTransfer",
+	"NonTransferable",
+	"InterestBearingConfig",
+	"CpiGuard",
+	"PermanentDelegate",
+	"NonTransferableAccount",
+	"TransferHook",
+	"TransferHookAccount",
+	"ConfidentialTransferFeeConfig",
+	"ConfidentialTransferFeeAmount",
+	"MetadataPointer",
+	"TokenMetadata",
+	"GroupPointer",
+	"TokenGroup",
+	"GroupMemberPointer",
+	"TokenGroupMember",
+}
+
+// token22Extensions walks the extension TLVs of a Token-2022 mint account & returns the value of each by type
+func token22Extensions(data []byte) map[uint16][]byte {
+	exts := map[uint16][]byte{}
+	if len(data) <= token22AccountTypeOffset || data[token22AccountTypeOffset] != token22AccountTypeMint {
+		return exts
+	}
+
+	pos := token22AccountTypeOffset + 1
+	for pos+4 <= len(data) {
+		extType := binary.LittleEndian.Uint16(data[pos:])
+		length := int(binary.LittleEndian.Uint16(data[pos+2:]))
+		pos += 4
+		if extType == 0 || pos+length > len(data) {
+			break
+		}
+		exts[extType] = data[pos : pos+length]
+		pos += length
+	}
+	return exts
+}
+
+// token22ExtensionName returns the readable name of an extension type
+func token22ExtensionName(extType uint16) string {
+	if int(extType) < len(token22ExtensionNames) {
+		return token22ExtensionNames[extType]
+	}
+	return fmt.Sprintf("Unknown(%v)", extType)
+}
+
+// token22MetadataPointer returns the metadata address of the MetadataPointer extension if set
+func token22MetadataPointer(exts map[uint16][]byte) *solana.PublicKey {
+	v, ok := exts[token22ExtMetadataPointer]
+	if !ok || len(v) < 64 {
+		return nil
+	}
+
+	addr := solana.PublicKeyFromBytes(v[32:64])
+	if addr.IsZero() {
+		return nil
+	}
+	return &addr
+}
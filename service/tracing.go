@@ -0,0 +1,120 @@
+package services
+
+import (
+	gocontext "context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/babilu-online/common/context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceConfig selects where spans are exported, tracing is disabled with the none exporter
+type TraceConfig struct {
+	Exporter    string  `yaml:"exporter" toml:"exporter"` // none, otlp or stdout
+	Endpoint    string  `yaml:"endpoint" toml:"endpoint"` // OTLP/HTTP host:port, OTEL_EXPORTER_OTLP_ENDPOINT is used when empty
+	Insecure    bool    `yaml:"insecure" toml:"insecure"` // Export over plain HTTP
+	ServiceName string  `yaml:"service_name" toml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio" toml:"sample_ratio"`
+}
+
+const (
+	TRACE_EXPORTER_NONE   = "none"
+	TRACE_EXPORTER_OTLP   = "otlp"
+	TRACE_EXPORTER_STDOUT = "stdout"
+)
+
+// tracer is resolved through the global provider so spans are no-ops until TracingService has started
+var tracer = otel.Tracer("github.com/alphabatem/nft-proxy/service")
+
+// TracingService installs the global tracer provider & flushes pending spans on shutdown
+type TracingService struct {
+	context.DefaultService
+
+	provider *sdktrace.TracerProvider
+}
+
+const TRACING_SVC = "tracing_svc"
+
+func (svc *TracingService) Id() string {
+	return TRACING_SVC
+}
+
+func (svc *TracingService) Start() error {
+	cfg := svc.Service(CONFIG_SVC).(*ConfigService).Config.Trace
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case TRACE_EXPORTER_NONE:
+		return nil
+	case TRACE_EXPORTER_OTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(gocontext.Background(), opts...)
+	case TRACE_EXPORTER_STDOUT:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return fmt.Errorf("unknown trace exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	svc.provider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(svc.provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return nil
+}
+
+// Shutdown flushes buffered spans to the exporter
+func (svc *TracingService) Shutdown() {
+	if svc.provider == nil {
+		return
+	}
+
+	ctx, cancel := gocontext.WithTimeout(gocontext.Background(), 5*time.Second)
+	defer cancel()
+	if err := svc.provider.Shutdown(ctx); err != nil {
+		Logger(LOG_TRACING).Error("Flushing traces failed", "err", err)
+	}
+}
+
+// endSpan records err on the span & ends it, use with defer on a named error return
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Span attribute keys not covered by semconv
+const (
+	attrMint        = attribute.Key("nft.mint")
+	attrRPCMethod   = attribute.Key("rpc.method")
+	attrImageFormat = attribute.Key("image.format")
+	attrImageWidth  = attribute.Key("image.width")
+	attrImageHeight = attribute.Key("image.height")
+	attrImageSize   = attribute.Key("image.target_size")
+	attrCacheHit    = attribute.Key("cache.hit")
+)
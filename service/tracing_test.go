@@ -0,0 +1,38 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestResizeSpan(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	svc := ResizeService{}
+	var out bytes.Buffer
+	if err := svc.Resize(context.Background(), testGIF(t, 1), &out, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "ResizeService.Resize" {
+		t.Fatalf("expected a single resize span, got %v", spans)
+	}
+
+	attrs := map[string]string{}
+	for _, kv := range spans[0].Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["image.format"] != "gif" || attrs["image.target_size"] != "100" || attrs["image.width"] == "" {
+		t.Fatalf("unexpected span attributes: %v", attrs)
+	}
+}
@@ -12,8 +12,26 @@ const (
 	PROTOCOL_TOKEN22_MINT
 	PROTOCOL_LIBREPLEX
 	PROTOCOL_METAPLEX_CORE
+	PROTOCOL_TOKEN22_POINTER
 )
 
+func (p Protocol) String() string {
+	switch p {
+	case PROTOCOL_LEGACY:
+		return "legacy"
+	case PROTOCOL_TOKEN22_MINT:
+		return "token22_mint"
+	case PROTOCOL_LIBREPLEX:
+		return "libreplex"
+	case PROTOCOL_METAPLEX_CORE:
+		return "metaplex_core"
+	case PROTOCOL_TOKEN22_POINTER:
+		return "token22_pointer"
+	default:
+		return "unknown"
+	}
+}
+
 type Metadata struct {
 	Key             token_metadata.Key
 	UpdateAuthority solana.PublicKey
@@ -26,6 +44,12 @@ type Metadata struct {
 	// Whether or not the data struct is mutable, default is not
 	IsMutable bool
 
+	// nonce for easy calculation of editions, if present
+	EditionNonce *uint8 `bin:"optional"`
+
+	// Since we cannot easily change Metadata, we add the new DataV2 fields here at the end.
+	TokenStandard *token_metadata.TokenStandard `bin:"optional"`
+
 	// Collection
 	Collection *token_metadata.Collection `bin:"optional"`
 
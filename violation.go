@@ -0,0 +1,22 @@
+package nft_proxy
+
+import "time"
+
+type ViolationStage string
+
+const (
+	ViolationStageFetch  ViolationStage = "fetch"
+	ViolationStageDecode ViolationStage = "decode"
+)
+
+// MediaViolation is the latest reason media for a mint was refused, kept per stage so repeat offenders can be reviewed
+type MediaViolation struct {
+	ID        uint           `json:"-" gorm:"primaryKey"`
+	Mint      string         `json:"mint" gorm:"uniqueIndex:idx_violation_mint_stage"`
+	Stage     ViolationStage `json:"stage" gorm:"uniqueIndex:idx_violation_mint_stage"`
+	Url       string         `json:"url"`
+	Reason    string         `json:"reason"`
+	Count     int            `json:"count"`
+	CreatedAt time.Time      `json:"createdAt"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}